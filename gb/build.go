@@ -17,37 +17,53 @@
 package main
 
 import (
-	//"time"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"time"
 )
 
 func CompilePkgSrc(pkg *Package, src []string, obj, pkgDest, testDest string) (err error) {
 
-	argv := []string{GetCompilerName()}
+	job := CompileJob{
+		ImportPath: pkg.Target,
+		Srcs:       src,
+		AsmSrcs:    pkg.AsmSrcs,
+		Obj:        obj,
+	}
+	if pkg.IsCmd {
+		job.ImportPath = "main"
+	}
 	if !pkg.IsInGOROOT {
-		argv = append(argv, "-I", pkgDest)
+		job.Includes = append(job.Includes, pkgDest)
 	}
 	if testDest != "" {
-		argv = append(argv, "-I", testDest)
+		job.Includes = append(job.Includes, testDest)
 	}
-	if len(GCFLAGS) > 0 {
-		argv = append(argv, GCFLAGS...)
+	if gcflags, set := pkg.Cfg.GCFlags(); set && gcflags != "" {
+		// split like the other flags when run, keeping quoted words whole
+		job.Flags = []string{gcflags}
 	}
-	argv = append(argv, "-o", obj)
-	if gcflags, set := pkg.Cfg.GCFlags(); set {
-		argv = append(argv, strings.Fields(gcflags)...)
-	}
-	argv = append(argv, src...)
 
-	err = RunExternal(CompileCMD, pkg.Dir, argv)
+	err = Tools.Compile(pkg, pkg.Dir, job, os.Stdout, os.Stderr)
 	return
 
 }
 
+// RemoveIntermediates removes the named files, and whatever else the
+// toolchain left behind, from dir.
+func RemoveIntermediates(dir string, names ...string) {
+	for _, name := range append(names, Tools.Intermediates()...) {
+		// most are only there after some builds
+		if Exec.Remove(filepath.Join(dir, name)) == nil && Verbose {
+			fmt.Printf("Removed %s\n", filepath.Join(dir, name))
+		}
+	}
+}
+
 func BuildPackage(pkg *Package) (err error) {
 
 	pkgDest := GetRelative(pkg.Dir, GetBuildDirPkg(), CWD)
@@ -66,22 +82,16 @@ func BuildPackage(pkg *Package) (err error) {
 		return
 	}
 	if !MakeAMess {
-		defer func() {
-			if Verbose {
-				fmt.Printf("Removing %s\n", filepath.Join(pkg.Dir, ibname))
-			}
-			os.Remove(filepath.Join(pkg.Dir, ibname))
-		}()
+		defer RemoveIntermediates(pkg.Dir, ibname)
 	}
 
 	asmObjs := []string{}
 	for _, asm := range pkg.AsmSrcs {
 		base := asm[0 : len(asm)-2] // definitely ends with '.s', so this is safe
-		asmObj := base + GetObjSuffix()
+		asmObj := base + Tools.ObjSuffix()
 		asmObjs = append(asmObjs, asmObj)
-		sargv := []string{GetAssemblerName(), asm}
 
-		err = RunExternal(AsmCMD, pkg.Dir, sargv)
+		err = Tools.Assemble(pkg, pkg.Dir, pkg.Target, asm, asmObj, os.Stdout, os.Stderr)
 		if err != nil {
 			return
 		}
@@ -90,44 +100,15 @@ func BuildPackage(pkg *Package) (err error) {
 	dst := GetRelative(pkg.Dir, pkg.ResultPath, CWD)
 
 	if pkg.IsCmd {
-
-		largs := []string{GetLinkerName()}
-
-		if len(GLDFLAGS) > 0 {
-			largs = append(largs, GLDFLAGS...)
-		}
-
-		if !pkg.IsInGOROOT {
-			largs = append(largs, "-L", pkgDest)
-		}
-		if testDest != "" {
-			largs = append(largs, "-L", testDest)
-		}
-
-		//largs = append(largs, "-o", dst, GetIBName())
-		largs = append(largs, "-o", pkg.Target, GetIBName())
-
-		//startLink := time.Nanoseconds()
-		err = RunExternal(LinkCMD, pkg.Dir, largs)
-		//durLink := time.Nanoseconds()-startLink
-		//fmt.Printf("link took %f\n", float64(durLink)/1e9)
-		dstDir, _ := filepath.Split(pkg.ResultPath)
-		if Verbose {
-			fmt.Printf("Creating directory %s\n", dstDir)
-		}
-		os.MkdirAll(dstDir, 0755)
-		Copy(pkg.Dir, pkg.Target, dst)
+		err = LinkCmd(pkg, append([]string{ibname}, asmObjs...), pkgDest, testDest)
 	} else {
 		dstDir, _ := filepath.Split(pkg.ResultPath)
 		if Verbose {
 			fmt.Printf("Creating directory %s\n", dstDir)
 		}
-		os.MkdirAll(dstDir, 0755)
-
-		argv := []string{"gopack", "grc", dst, GetIBName()}
-		argv = append(argv, asmObjs...)
+		Exec.MkdirAll(dstDir)
 
-		if err = RunExternal(PackCMD, pkg.Dir, argv); err != nil {
+		if err = Tools.Pack(pkg, pkg.Dir, dst, append([]string{ibname}, asmObjs...), os.Stdout, os.Stderr); err != nil {
 			return
 		}
 	}
@@ -140,52 +121,132 @@ func BuildPackage(pkg *Package) (err error) {
 
 	return
 }
-func BuildTest(pkg *Package) (err error) {
+
+// LinkCmd links a command from objs, the first being its compiled Go code,
+// and copies the binary to pkg.ResultPath.
+func LinkCmd(pkg *Package, objs []string, pkgDest, testDest string) (err error) {
+	var libs []string
+	if !pkg.IsInGOROOT {
+		libs = append(libs, pkgDest)
+	}
+	if testDest != "" {
+		libs = append(libs, testDest)
+	}
+
+	ldflags, err := pkg.CGoLinkFlags(false)
+	if err != nil {
+		return
+	}
+
+	//startLink := time.Nanoseconds()
+	err = Tools.Link(pkg, pkg.Dir, pkg.Target, objs, libs, ldflags, os.Stdout, os.Stderr)
+	//durLink := time.Nanoseconds()-startLink
+	//fmt.Printf("link took %f\n", float64(durLink)/1e9)
+	if err != nil {
+		return
+	}
+	dstDir, _ := filepath.Split(pkg.ResultPath)
+	if Verbose {
+		fmt.Printf("Creating directory %s\n", dstDir)
+	}
+	Exec.MkdirAll(dstDir)
+	Copy(pkg.Dir, pkg.Target, GetRelative(pkg.Dir, pkg.ResultPath, CWD))
+	return
+}
+
+// BuildTest compiles the package, from pkgSrc, with its tests, and links them
+// with the generated _testmain.go into testBinary, relative to pkg.Dir.
+func BuildTest(pkg *Package, pkgSrc []string, stdout, stderr io.Writer) (testBinary string, err error) {
 
 	reverseDots := ReverseDir(pkg.Dir)
 	pkgDest := filepath.Join(reverseDots, GetBuildDirPkg())
 
-	testIB := filepath.Join("_test", "_gotest_"+GetObjSuffix())
+	testIB := filepath.Join("_test", "_gotest_"+Tools.ObjSuffix())
+	testIncludes := []string{filepath.Join("_test", "_obj"), pkgDest}
+
+	if !MakeAMess {
+		defer RemoveIntermediates(pkg.Dir)
+	}
 
 	//fmt.Printf("%v %v\n", pkg.TestSrc, pkg.Name)
 
 	buildTestName := func(testName string) (err error) {
 
-		testSrcs := pkg.TestSrc[testName]
+		cgoTestSrcs := pkg.TestCGoSrc[testName]
+		isCGoTest := make(map[string]bool)
+		for _, src := range cgoTestSrcs {
+			isCGoTest[src] = true
+		}
+		var testSrcs []string
+		for _, src := range pkg.TestSrc[testName] {
+			if !isCGoTest[src] {
+				testSrcs = append(testSrcs, src)
+			}
+		}
 
-		argv := []string{GetCompilerName()}
-		argv = append(argv, "-I", filepath.Join("_test", "_obj"))
-		argv = append(argv, "-I", pkgDest)
-		if GCFLAGS != nil {
-			argv = append(argv, GCFLAGS...)
+		job := CompileJob{
+			ImportPath: testName,
+			Obj:        testIB,
+			Includes:   testIncludes,
 		}
-		argv = append(argv, "-o", testIB)
 		if testName == pkg.Name {
-			argv = append(argv, pkg.PkgSrc[pkg.Name]...)
+			job.ImportPath = pkg.Target
+			job.Srcs = append(job.Srcs, pkgSrc...)
+		}
+		job.Srcs = append(job.Srcs, testSrcs...)
+
+		// a cgo package is rebuilt along with its tests, so its cgo sources
+		// go through cgo again with the ones in the tests
+		var cgoSrcs, cSrcs, cflags, ldflags []string
+		if testName == pkg.Name && pkg.IsCGo {
+			cgoSrcs = append(cgoSrcs, pkg.CGoSources...)
+			cSrcs = pkg.CSrcs
+			if cflags, ldflags, err = pkg.CGoFlags(pkg.Name, false); err != nil {
+				return
+			}
+		}
+		cgoSrcs = append(cgoSrcs, cgoTestSrcs...)
+		testCFlags, testLDFlags, err := pkg.CGoFlags(testName, true)
+		if err != nil {
+			return
+		}
+		cflags = append(cflags, testCFlags...)
+		ldflags = append(ldflags, testLDFlags...)
+
+		var cgoObjs []string
+		if len(cgoSrcs) != 0 || len(cSrcs) != 0 {
+			if GCCCMD == "" || CGoCMD == "" {
+				return errors.New(fmt.Sprintf("(in %s) gcc and cgo are needed to test cgo sources", pkg.Dir))
+			}
+			var cgoGo []string
+			cgoRel := filepath.Join("_test", "_cgo_"+testName)
+			cgoGo, cgoObjs, err = RunCgo(pkg, cgoRel, job.ImportPath, testName, cgoSrcs, cSrcs, cflags, ldflags, stdout, stderr)
+			if err != nil {
+				return
+			}
+			job.Srcs = append(job.Srcs, cgoGo...)
 		}
-		argv = append(argv, testSrcs...)
 
-		if err = RunExternal(CompileCMD, pkg.Dir, argv); err != nil {
+		if err = Tools.Compile(pkg, pkg.Dir, job, stdout, stderr); err != nil {
 			return
 		}
 
 		//see if it was created
-		if _, err = os.Stat(filepath.Join(pkg.Dir, testIB)); err != nil {
+		if _, err = os.Stat(filepath.Join(pkg.Dir, testIB)); err != nil && !DryRun {
 			return errors.New("compile error")
 		}
-		dst := filepath.Join("_test", "_obj", testName) + ".a"
+		err = nil
+		dst := filepath.Join("_test", "_obj", Tools.ArchiveName(testName))
 
 		if testName == pkg.Name {
-			dst = filepath.Join("_test", "_obj", pkg.Target) + ".a"
+			dst = filepath.Join("_test", "_obj", Tools.ArchiveName(pkg.Target))
 		}
 
 		mkdirdst := filepath.Join(pkg.Dir, dst)
 		dstDir, _ := filepath.Split(mkdirdst)
-		os.MkdirAll(dstDir, 0755)
+		Exec.MkdirAll(dstDir)
 
-		argv = []string{"gopack", "grc", dst, testIB}
-
-		if err = RunExternal(PackCMD, pkg.Dir, argv); err != nil {
+		if err = Tools.Pack(pkg, pkg.Dir, dst, append([]string{testIB}, cgoObjs...), stdout, stderr); err != nil {
 			return
 		}
 
@@ -207,53 +268,97 @@ func BuildTest(pkg *Package) (err error) {
 		}
 	}
 
-	testmainib := filepath.Join("_test", "_testmain"+GetObjSuffix())
+	testmainib := filepath.Join("_test", "_testmain"+Tools.ObjSuffix())
 
-	argv := []string{GetCompilerName()}
-	argv = append(argv, "-I", filepath.Join("_test", "_obj"))
-	argv = append(argv, "-I", pkgDest)
-	if GCFLAGS != nil {
-		argv = append(argv, GCFLAGS...)
+	job := CompileJob{
+		ImportPath: "main",
+		Srcs:       []string{filepath.Join("_test", "_testmain.go")},
+		Obj:        testmainib,
+		Includes:   testIncludes,
 	}
-	argv = append(argv, "-o", testmainib)
-	argv = append(argv, filepath.Join("_test", "_testmain.go"))
-
-	if err = RunExternal(CompileCMD, pkg.Dir, argv); err != nil {
+	if err = Tools.Compile(pkg, pkg.Dir, job, stdout, stderr); err != nil {
 		return
 	}
 
-	testBinary := filepath.Join("_test", "_testmain")
+	testBinary = filepath.Join("_test", "_testmain")
 	if GOOS == "windows" {
 		testBinary += ".exe"
 	}
 
-	largs := []string{GetLinkerName()}
-	largs = append(largs, "-L", filepath.Join("_test", "_obj"))
-	largs = append(largs, "-L", pkgDest)
-	if len(GLDFLAGS) > 0 {
-		largs = append(largs, GLDFLAGS...)
+	ldflags, err := pkg.CGoLinkFlags(true)
+	if err != nil {
+		return
 	}
-	largs = append(largs, "-o", testBinary, testmainib)
+	err = Tools.Link(pkg, pkg.Dir, testBinary, []string{testmainib}, testIncludes, ldflags, stdout, stderr)
+	return
+}
+
+// TestTimeout tells how long the target's test binary may run before it is
+// killed. --test-timeout overrides a testtimeout= in the target's gb.cfg, and
+// zero means no limit.
+func (this *Package) TestTimeout() (timeout time.Duration, err error) {
+	if TestTimeout != 0 {
+		timeout = TestTimeout
+		return
+	}
+	if value, set := this.Cfg.TestTimeout(); set {
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			err = errors.New(fmt.Sprintf("(in %s) testtimeout=%s is not a duration like 30s or 5m", this.Dir, value))
+		}
+	}
+	return
+}
 
-	if err = RunExternal(LinkCMD, pkg.Dir, largs); err != nil {
+// RunTest runs a test binary made by BuildTest, recording its results if a
+// test report was asked for.
+func RunTest(pkg *Package, testBinary string, stdout, stderr io.Writer) (err error) {
+	var timeout time.Duration
+	if timeout, err = pkg.TestTimeout(); err != nil {
+		ErrLog.Println(err)
+		ReportFailed()
 		return
 	}
+
 	var testBinaryAbs string
 	testBinaryAbs = GetAbs(filepath.Join(pkg.Dir, testBinary), CWD)
 	testargs := append([]string{testBinary}, TestArgs...)
 
-	if err = RunExternal(testBinaryAbs, pkg.Dir, testargs); err != nil {
-		ReturnFailCode = true
-		return
+	var output bytes.Buffer
+	if TestReportFormat != "" {
+		// the report needs a line for every test, not just the failures
+		if !HasTestVerbose(testargs) {
+			testargs = append(testargs, "-test.v")
+		}
+		stdout, stderr = io.MultiWriter(stdout, &output), io.MultiWriter(stderr, &output)
+	}
+
+	start := time.Now()
+	killed, err := RunExternalTimeout(testBinaryAbs, pkg.Dir, testargs, stdout, stderr, timeout)
+	if killed {
+		err = errors.New(fmt.Sprintf("(in %s) tests for \"%s\" did not finish in %v and were killed", pkg.Dir, pkg.Target, timeout))
+		fmt.Fprintf(stderr, "%v\n", err)
+	}
+
+	if TestReportFormat != "" {
+		report := ParseTestOutput(pkg.Target, output.String(), time.Now().Sub(start), err)
+		if killed {
+			report.Err = err
+		}
+		RecordTestReport(report)
+	}
+	if err != nil {
+		ReportFailed()
 	}
 
 	return
 }
+
 func InstallPackage(pkg *Package) (err error) {
 	dstDir, _ := filepath.Split(pkg.InstallPath)
 	_, dstName := filepath.Split(pkg.ResultPath)
 	dstFile := filepath.Join(dstDir, dstName)
-	err = os.MkdirAll(dstDir, 0755)
+	err = Exec.MkdirAll(dstDir)
 	if err != nil {
 		return
 	}
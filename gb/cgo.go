@@ -17,9 +17,14 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 )
 
 /*
@@ -61,76 +66,27 @@ func BuildCgoPackage(pkg *Package) (err error) {
 		return MakeBuild(pkg)
 	}
 
-	var CFLAGS []string
-	var LDFLAGS []string
-
-	switch GOARCH {
-	case "amd64":
-		CFLAGS = []string{"-m64"}
-	default:
-		CFLAGS = []string{"-m32"}
-	}
-
-	switch GOOS {
-	case "freebsd":
-	case "linux":
-		LDFLAGS = []string{"-shared", "-lpthread", "-lm"}
-	case "darwin":
-		LDFLAGS = []string{"-dynamiclib", "-Wl,-undefined,dynamic_lookup"}
-	case "windows":
-		LDFLAGS = []string{"-shared", "-lm", "-mthreads"}
-	}
-
-	_ = LDFLAGS // apparently the makefile doesn't use them...
-
-	cgodir := filepath.Join(pkg.Dir, "_cgo")
-
-	if Verbose {
-		fmt.Printf("Creating directory %s\n", cgodir)
-	}
-	err = os.MkdirAll(cgodir, 0755)
-	if err != nil {
-		return
-	}
-
 	if !MakeAMess {
 		defer func() {
+			cgodir := filepath.Join(pkg.Dir, "_cgo")
 			if Verbose {
 				fmt.Printf("Removing directory %s\n", cgodir)
 			}
-			os.RemoveAll(cgodir)
+			Exec.RemoveAll(cgodir)
 		}()
 	}
 
-	var cgobases []string
-
-	//first run cgo
-	//CGOPKGPATH= cgo --  e1.go e2.go
-	cgo_argv := []string{"cgo", "--", "-I.."}
-	for _, cgosrc := range pkg.CGoSources {
-		cgb := filepath.Base(cgosrc)
-		cgobases = append(cgobases, cgb)
-		cgd := filepath.Join("_cgo", cgb)
-		err = Copy(pkg.Dir, cgosrc, cgd)
-		cgo_argv = append(cgo_argv, cgb)
-	}
-	if len(pkg.CGoSources) != 0 {
-		if Verbose {
-			fmt.Printf("%s:", cgodir)
-		}
-		err = RunExternal(CGoCMD, cgodir, cgo_argv)
-		if err != nil {
-			return
-		}
+	importPath := pkg.Target
+	if pkg.IsCmd {
+		importPath = "main"
 	}
-
-	var allsrc []string
-	if len(pkg.CGoSources) != 0 {
-		allsrc = append(allsrc, filepath.Join("_cgo", "_obj", "_cgo_gotypes.go"))
+	cflags, ldflags, err := pkg.CGoFlags(pkg.Name, false)
+	if err != nil {
+		return
 	}
-	for _, src := range cgobases {
-		gs := src[:len(src)-3] + ".cgo1.go"
-		allsrc = append(allsrc, filepath.Join("_cgo", "_obj", gs))
+	allsrc, objs, err := RunCgo(pkg, "_cgo", importPath, pkg.Name, pkg.CGoSources, pkg.CSrcs, cflags, ldflags, os.Stdout, os.Stderr)
+	if err != nil {
+		return
 	}
 	allsrc = append(allsrc, pkg.PkgSrc[pkg.Name]...)
 
@@ -150,33 +106,97 @@ func BuildCgoPackage(pkg *Package) (err error) {
 		return
 	}
 
-	defer func() {
-		if Verbose {
-			fmt.Printf("Removing %s\n", filepath.Join(pkg.Dir, ibname))
-		}
-		os.Remove(filepath.Join(pkg.Dir, ibname))
-	}()
+	defer RemoveIntermediates(pkg.Dir, ibname)
 
-	//6c -FVw -I/Users/jasmuth/Documents/userland/go/pkg/darwin_amd64 _cgo_defun.c
+	if pkg.IsCmd {
+		err = LinkCmd(pkg, append([]string{ibname}, objs...), pkgDest, testDest)
+		return
+	}
 
-	gorootObj := filepath.Join(GOROOT, "pkg", GOOS+"_"+GOARCH)
+	/*clean/link
+	rm -f _obj/e.a
+	gopack grc _obj/e.a _go_.6  _cgo_defun.6 _cgo_import.6 e1.cgo2.o e2.cgo2.o _cgo_export.o
+	*/
+	dst := GetRelative(".", pkg.ResultPath, CWD)
+	reldst := GetRelative(pkg.Dir, pkg.ResultPath, CWD)
+	dstDir, _ := filepath.Split(dst)
+	if Verbose {
+		fmt.Printf("Creating directory %s\n", dstDir)
+	}
+	err = Exec.MkdirAll(dstDir)
+	if err != nil {
+		return
+	}
+	if Verbose {
+		fmt.Printf("Removing %s\n", dst)
+	}
+	Exec.Remove(dst)
 
-	cdefargv := []string{GetCCompilerName(), "-FVw", "-I" + gorootObj}
+	err = Tools.Pack(pkg, pkg.Dir, reldst, append([]string{ibname}, objs...), os.Stdout, os.Stderr)
+	return
+}
+
+// RunCgo runs cgo on cgoSrcs and compiles the C code they need, along with
+// cSrcs, in cgoRel, a directory inside pkg.Dir. It returns the Go files to
+// compile with the rest of the package and the objects to pack with it, both
+// relative to pkg.Dir. BuildCgoPackage runs it for the package's own sources,
+// and BuildTest for the package's sources together with its tests.
+func RunCgo(pkg *Package, cgoRel, importPath, name string, cgoSrcs, cSrcs, cgoCFlags, cgoLDFlags []string, stdout, stderr io.Writer) (gosrcs, objs []string, err error) {
+	var CFLAGS []string
+	var LDFLAGS []string
 
-	for _, objdst := range GOPATH_OBJDSTS {
-		cdefargv = append(cdefargv, "-I"+objdst)
+	switch GOARCH {
+	case "amd64":
+		CFLAGS = []string{"-m64"}
+	default:
+		CFLAGS = []string{"-m32"}
 	}
 
-	cdefargv = append(cdefargv, filepath.Join("_obj", "_cgo_defun.c"))
+	// _cgo1_.o is linked as an executable, only so the toolchain can see
+	// which dynamic symbols it needs, so these leave out -shared
+	switch GOOS {
+	case "freebsd":
+		LDFLAGS = []string{"-lpthread", "-lm"}
+	case "linux":
+		LDFLAGS = []string{"-lpthread", "-lm"}
+	case "darwin":
+		LDFLAGS = []string{"-Wl,-undefined,dynamic_lookup"}
+	case "windows":
+		LDFLAGS = []string{"-lm", "-mthreads"}
+	}
+
+	cgodir := filepath.Join(pkg.Dir, cgoRel)
+	// the package's directory, as seen from cgodir
+	pkgRel := GetRelative(cgodir, pkg.Dir, CWD)
 
 	if Verbose {
-		fmt.Printf("%s:", cgodir)
+		fmt.Fprintf(stdout, "Creating directory %s\n", cgodir)
 	}
-	err = RunExternal(CCMD, cgodir, cdefargv)
+	err = Exec.MkdirAll(cgodir)
 	if err != nil {
 		return
 	}
 
+	var cgobases []string
+
+	//first run cgo
+	//CGOPKGPATH= cgo --  e1.go e2.go
+	for _, cgosrc := range cgoSrcs {
+		cgb := filepath.Base(cgosrc)
+		cgobases = append(cgobases, cgb)
+		cgd := filepath.Join(cgoRel, cgb)
+		err = Copy(pkg.Dir, cgosrc, cgd)
+	}
+	if len(cgoSrcs) != 0 {
+		if Verbose {
+			fmt.Fprintf(stdout, "%s:", cgodir)
+		}
+		err = Tools.Cgo(pkg, cgodir, importPath, cgobases, cgoCFlags, stdout, stderr)
+		if err != nil {
+			return
+		}
+	}
+
 	// compile all the new C source
 	/*
 		gcc -m64 -g -fPIC -O2 -o _cgo_main.o -c   _cgo_main.c
@@ -185,15 +205,15 @@ func BuildCgoPackage(pkg *Package) (err error) {
 		gcc -m64 -g -fPIC -O2 -o _cgo_export.o -c   _cgo_export.c
 	*/
 	gccCompile := func(src, obj string) (err error) {
-		gccargv := []string{"gcc", "-I..", "-I."}
+		gccargv := []string{"gcc", "-I" + pkgRel, "-I."}
 		gccargv = append(gccargv, CFLAGS...)
 		gccargv = append(gccargv, []string{"-g", "-fPIC", "-O2", "-o", obj, "-c"}...)
-		gccargv = append(gccargv, pkg.CGoCFlags[pkg.Name]...)
+		gccargv = append(gccargv, cgoCFlags...)
 		gccargv = append(gccargv, src)
 		if Verbose {
-			fmt.Printf("%s:", cgodir)
+			fmt.Fprintf(stdout, "%s:", cgodir)
 		}
-		err = RunExternal(GCCCMD, cgodir, gccargv)
+		err = RunExternalTo(GCCCMD, cgodir, gccargv, stdout, stderr)
 		return
 	}
 	var cobjs []string
@@ -210,11 +230,11 @@ func BuildCgoPackage(pkg *Package) (err error) {
 		}
 	}
 
-	for _, csrc := range pkg.CSrcs {
+	for _, csrc := range cSrcs {
 		cobj := csrc[:len(csrc)-2] + ".o"
 		cobj = filepath.Base(cobj)
 		cobjs = append(cobjs, cobj)
-		relsrc := GetRelative("_cgo", csrc, filepath.Join(CWD, pkg.Dir))
+		relsrc := GetRelative(cgoRel, csrc, filepath.Join(CWD, pkg.Dir))
 		err = gccCompile(relsrc, cobj)
 		if err != nil {
 			return
@@ -237,85 +257,165 @@ func BuildCgoPackage(pkg *Package) (err error) {
 	gcclargv = append(gcclargv, []string{"-g", "-fPIC", "-O2", "-o", "_cgo1_.o"}...)
 	gcclargv = append(gcclargv, "_cgo_main.o")
 	gcclargv = append(gcclargv, cobjs...)
-	gcclargv = append(gcclargv, pkg.CGoLDFlags[pkg.Name]...)
+	gcclargv = append(gcclargv, cgoLDFlags...)
+	gcclargv = append(gcclargv, LDFLAGS...)
 
 	if Verbose {
-		fmt.Printf("%s:", cgodir)
+		fmt.Fprintf(stdout, "%s:", cgodir)
 	}
-	err = RunExternal(GCCCMD, cgodir, gcclargv)
+	err = RunExternalTo(GCCCMD, cgodir, gcclargv, stdout, stderr)
 	if err != nil {
 		return
 	}
 
-	//cgo -dynimport _cgo1_.o >__cgo_import.c && mv -f __cgo_import.c _cgo_import.c
-	dynargv := []string{"cgo", "-dynimport", "_cgo1_.o"}
+	// let the toolchain find out which dynamic symbols the C code needs
 	if Verbose {
-		fmt.Printf("%s:", cgodir)
-		fmt.Printf("writing to %s\n", "__cgo_import.c")
+		fmt.Fprintf(stdout, "%s:", cgodir)
 	}
-
-	var dump *os.File
-	dump, err = os.Create(filepath.Join(cgodir, "__cgo_import.c"))
+	importGo, importObjs, err := Tools.CgoImports(pkg, cgodir, name, "_cgo1_.o", stdout, stderr)
 	if err != nil {
 		return
 	}
-	err = RunExternalDump(CGoCMD, cgodir, dynargv, dump)
-	if err != nil {
-		return
+
+	if len(cgoSrcs) != 0 {
+		gosrcs = append(gosrcs, filepath.Join(cgoRel, "_obj", "_cgo_gotypes.go"))
+	}
+	for _, src := range cgobases {
+		gs := src[:len(src)-3] + ".cgo1.go"
+		gosrcs = append(gosrcs, filepath.Join(cgoRel, "_obj", gs))
+	}
+	for _, src := range importGo {
+		gosrcs = append(gosrcs, filepath.Join(cgoRel, src))
 	}
-	dump.Close()
 
-	//mv __cgo_import.c _cgo_import.c
-	if Verbose {
-		fmt.Printf("%s:", cgodir)
-		fmt.Printf("Moving __cgo_import.c to _cgo_import.c\n")
+	for _, obj := range append(importObjs, cobjs...) {
+		objs = append(objs, filepath.Join(cgoRel, obj))
 	}
-	err = os.Rename(filepath.Join(cgodir, "__cgo_import.c"), filepath.Join(cgodir, "_cgo_import.c"))
+	return
+}
+
+// CGoFlags gives the #cgo CFLAGS and LDFLAGS of the package name in the
+// target, or of its tests if test is set, followed by the ones pkg-config
+// gives for its #cgo pkg-config directives.
+func (this *Package) CGoFlags(name string, test bool) (cflags, ldflags []string, err error) {
+	var libs []string
+	if test {
+		cflags = append(cflags, this.TestCGoCFlags[name]...)
+		ldflags = append(ldflags, this.TestCGoLDFlags[name]...)
+		libs = this.TestCGoPkgConfig[name]
+	} else {
+		cflags = append(cflags, this.CGoCFlags[name]...)
+		ldflags = append(ldflags, this.CGoLDFlags[name]...)
+		libs = this.CGoPkgConfig[name]
+	}
+	if len(libs) == 0 {
+		return
+	}
+	pcCFlags, pcLDFlags, err := PkgConfig(this.Dir, libs)
 	if err != nil {
 		return
 	}
+	cflags = append(cflags, pcCFlags...)
+	ldflags = append(ldflags, pcLDFlags...)
+	return
+}
 
-	/* compile the C bits
-	6c -FVw _cgo_import.c
-	*/
-	ccargv := []string{GetCCompilerName(), "-FVw", "_cgo_import.c"}
-	if Verbose {
-		fmt.Printf("%s:", cgodir)
+// CGoLinkFlags collects the LDFLAGS of the target and of every cgo package
+// it imports, in the order a binary should be linked with them. If test is
+// set, the flags of the target's tests and the packages they import are
+// included.
+func (this *Package) CGoLinkFlags(test bool) (ldflags []string, err error) {
+	seen := make(map[*Package]bool)
+	var collect func(pkg *Package) error
+	collect = func(pkg *Package) (err error) {
+		if seen[pkg] {
+			return
+		}
+		seen[pkg] = true
+		if pkg.IsCGo {
+			var flags []string
+			if _, flags, err = pkg.CGoFlags(pkg.Name, false); err != nil {
+				return
+			}
+			ldflags = append(ldflags, flags...)
+		}
+		for _, dep := range pkg.DepPkgs {
+			if err = collect(dep); err != nil {
+				return
+			}
+		}
+		return
 	}
-	err = RunExternal(CCMD, cgodir, ccargv)
-	if err != nil {
+	if test {
+		for name := range this.TestCGoSrc {
+			var flags []string
+			if _, flags, err = this.CGoFlags(name, true); err != nil {
+				return
+			}
+			ldflags = append(ldflags, flags...)
+		}
+	}
+	if err = collect(this); err != nil {
 		return
 	}
-
-	/*clean/link
-	rm -f _obj/e.a
-	gopack grc _obj/e.a _go_.6  _cgo_defun.6 _cgo_import.6 e1.cgo2.o e2.cgo2.o _cgo_export.o
-	*/
-	dst := GetRelative(".", pkg.ResultPath, CWD)
-	reldst := GetRelative(pkg.Dir, pkg.ResultPath, CWD)
-	dstDir, _ := filepath.Split(dst)
-	if Verbose {
-		fmt.Printf("Creating directory %s\n", dstDir)
+	if test {
+		for _, dep := range this.TestDepPkgs {
+			if err = collect(dep); err != nil {
+				return
+			}
+		}
 	}
-	err = os.MkdirAll(dstDir, 0755)
-	if err != nil {
+	return
+}
+
+var pkgConfigFlags = make(map[string][2][]string)
+var pkgConfigLock sync.Mutex
+
+// PkgConfig asks pkg-config for the flags needed to compile against and link
+// with the named libraries. The answers are remembered for the rest of the
+// run.
+func PkgConfig(dir string, libs []string) (cflags, ldflags []string, err error) {
+	key := strings.Join(libs, " ")
+	if PkgConfigCMD == "" {
+		err = errors.New(fmt.Sprintf("(in %s) pkg-config is needed for \"#cgo pkg-config: %s\", but it is not in $PATH", dir, key))
+		ErrLog.Println(err)
 		return
 	}
-	if Verbose {
-		fmt.Printf("Removing %s\n", dst)
+
+	pkgConfigLock.Lock()
+	defer pkgConfigLock.Unlock()
+
+	if flags, ok := pkgConfigFlags[key]; ok {
+		cflags, ldflags = flags[0], flags[1]
+		return
 	}
-	os.Remove(dst)
 
-	relobjs := []string{}
-	for _, cobj := range cobjs {
-		relobjs = append(relobjs, filepath.Join("_cgo", cobj))
+	for _, lib := range libs {
+		if QueryExternal(PkgConfigCMD, dir, []string{"pkg-config", "--exists", lib}, nil, nil) != nil {
+			err = errors.New(fmt.Sprintf("(in %s) pkg-config cannot find %s.pc, asked for by \"#cgo pkg-config: %s\"; install the development files for %s, or add the directory with %s.pc to $PKG_CONFIG_PATH", dir, lib, key, lib, lib))
+			ErrLog.Println(err)
+			return
+		}
 	}
-	packargv := []string{"gopack", "grc", reldst, GetIBName(),
-		filepath.Join("_cgo", "_cgo_defun"+GetObjSuffix()),
-		filepath.Join("_cgo", "_cgo_import"+GetObjSuffix())}
-	packargv = append(packargv, relobjs...)
 
-	err = RunExternal(PackCMD, pkg.Dir, packargv)
+	query := func(flag string) (flags []string, err error) {
+		var stdout, stderr bytes.Buffer
+		argv := append([]string{"pkg-config", flag}, libs...)
+		if err = QueryExternal(PkgConfigCMD, dir, argv, &stdout, &stderr); err != nil {
+			err = errors.New(fmt.Sprintf("(in %s) pkg-config %s %s: %s", dir, flag, key, strings.TrimSpace(stderr.String())))
+			ErrLog.Println(err)
+			return
+		}
+		flags = strings.Fields(stdout.String())
+		return
+	}
+	if cflags, err = query("--cflags"); err != nil {
+		return
+	}
+	if ldflags, err = query("--libs"); err != nil {
+		return
+	}
+	pkgConfigFlags[key] = [2][]string{cflags, ldflags}
 	return
 }
 
@@ -328,7 +428,7 @@ func CleanCGoPackage(pkg *Package) (err error) {
 	if Verbose {
 		fmt.Printf(" Removing %s\n", filepath.Join(pkg.Dir, "_cgo"))
 	}
-	os.RemoveAll(filepath.Join(pkg.Dir, "_cgo"))
+	Exec.RemoveAll(filepath.Join(pkg.Dir, "_cgo"))
 
 	return
 }
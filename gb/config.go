@@ -17,17 +17,22 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 )
 
 type Config map[string]string
 
+// ConfigSources tells which file, and line, each key of a Config came from.
+type ConfigSources map[string]string
+
 func (cfg Config) ProtobufPlugin() (plugin string, set bool) {
 	plugin, set = cfg["proto"]
 	return
@@ -79,94 +84,460 @@ func (cfg Config) GCFlags() (gcflags string, set bool) {
 	return
 }
 
+func (cfg Config) Tags() (tags []string, set bool) {
+	var list string
+	list, set = cfg["tags"]
+	tags = SplitTags(list)
+	return
+}
+
+func (cfg Config) Toolchain() (name string, set bool) {
+	name, set = cfg["toolchain"]
+	return
+}
+
+func (cfg Config) TestTimeout() (timeout string, set bool) {
+	timeout, set = cfg["testtimeout"]
+	return
+}
+
 func (cfg Config) Pkgdir() (pkgdir string, set bool) {
 	pkgdir, set = cfg["pkgdir"]
 	return
 }
 
-func (cfg Config) Write(dir string) (err error) {
+// Equal tells whether two configurations set the same keys to the same
+// values.
+func (cfg Config) Equal(other Config) bool {
+	if len(cfg) != len(other) {
+		return false
+	}
+	for key, value := range cfg {
+		if otherValue, ok := other[key]; !ok || otherValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// SetConfig sets key to value in the gb.cfg of dir. Only the line that sets
+// or unsets key changes, or one is added at the end, so the comments,
+// continuations and variables in the rest of the file are kept. The settings
+// of the older target.gb and workspace.gb files move into the gb.cfg.
+func SetConfig(dir, key, value string) (err error) {
 	path := filepath.Join(dir, "gb.cfg")
-	var fout *os.File
-	fout, err = os.Create(path)
-	if err != nil {
+	text, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
 		return
 	}
+	err = nil
+
+	setting := func(key, value string) string {
+		// nothing between single quotes is expanded when it is read back
+		if value != "" {
+			value = quoteConfigWord(value, " \t\n\"'\\#$")
+		}
+		return key + "=" + value + "\n"
+	}
 
-	for key, val := range cfg {
-		fmt.Fprintf(fout, "%s=%s\n", key, val)
+	var out []string
+	found := false
+	seen := make(map[string]bool)
+	lines := strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i := 0; i < len(lines); i++ {
+		first := i
+		line := strings.TrimRight(lines[i], " \t\r\n")
+		for strings.HasSuffix(line, "\\") && i+1 < len(lines) {
+			i++
+			line = line[:len(line)-1] + " " + strings.TrimSpace(lines[i])
+		}
+		lineKey := configLineKey(line)
+		seen[lineKey] = true
+		if lineKey == key || lineKey == "!"+key {
+			if !found {
+				out = append(out, setting(key, value))
+				found = true
+			}
+			continue
+		}
+		out = append(out, lines[first:i+1]...)
+	}
+	if len(out) != 0 && !strings.HasSuffix(out[len(out)-1], "\n") {
+		out[len(out)-1] += "\n"
 	}
 
-	fout.Close()
+	for _, oneKey := range []string{"target", "workspace"} {
+		oneFile := filepath.Join(dir, oneKey+".gb")
+		oneValue, _ := ReadOneLine(oneFile)
+		if oneValue != "" && oneKey != key && !seen[oneKey] && !seen["!"+oneKey] {
+			out = append(out, setting(oneKey, oneValue))
+		}
+	}
+	if !found {
+		out = append(out, setting(key, value))
+	}
 
-	os.Remove(filepath.Join(dir, "target.gb"))
-	os.Remove(filepath.Join(dir, "workspace.gb"))
+	if err = WriteFile(path, []byte(strings.Join(out, "")), 0644); err != nil {
+		return
+	}
+
+	Exec.Remove(filepath.Join(dir, "target.gb"))
+	Exec.Remove(filepath.Join(dir, "workspace.gb"))
 
 	return
 }
 
-func oneLiner(key, path string, cfg Config) {
+// configLineKey gives the key a gb.cfg line sets, or "!key" if it unsets it.
+func configLineKey(line string) string {
+	line = strings.TrimSpace(stripConfigComment(line))
+	if strings.HasPrefix(line, "!") {
+		return "!" + strings.ToLower(strings.TrimSpace(line[1:]))
+	}
+	if eq := strings.Index(line, "="); eq != -1 {
+		return strings.ToLower(strings.TrimSpace(line[:eq]))
+	}
+	return ""
+}
+
+func oneLiner(key, path string, cfg Config, sources ConfigSources) {
 
 	val, err := ReadOneLine(path)
 
 	if err == nil && val != "" {
 		cfg[key] = val
+		sources[key] = path
 	}
 
 	return
 }
 
+// the keys that also apply to the directories below, unless they set or
+// unset them
+var cascadingKeys = map[string]bool{
+	"proto":       true,
+	"makefile":    true,
+	"gcflags":     true,
+	"pkgdir":      true,
+	"tags":        true,
+	"testtimeout": true,
+}
+
 var knownKeys = map[string]bool{
-	"proto":     true,
-	"target":    true,
-	"workspace": true,
-	"makefile":  true,
-	"ignore":    true,
-	"ignoreall": true,
-	"gcflags":   true,
-	"pkgdir":    true,
+	"proto":       true,
+	"target":      true,
+	"workspace":   true,
+	"makefile":    true,
+	"ignore":      true,
+	"ignoreall":   true,
+	"gcflags":     true,
+	"pkgdir":      true,
+	"tags":        true,
+	"goos":        true,
+	"goarch":      true,
+	"toolchain":   true,
+	"testtimeout": true,
 }
 
 func ReadConfig(dir string) (cfg Config) {
-	cfg = make(map[string]string)
+	cfg, _ = ReadConfigSources(dir)
+	return
+}
 
-	path := filepath.Join(dir, "gb.cfg")
-	fin, existserr := os.Open(path)
-	if existserr == nil {
+// ReadConfigSources reads a directory's own gb.cfg, saying which file and
+// line each key came from. A line "!key" unsets a key that would otherwise be
+// inherited; it shows up as the key "!key". The lines with problems are
+// skipped.
+func ReadConfigSources(dir string) (cfg Config, sources ConfigSources) {
+	cfg, sources = make(Config), make(ConfigSources)
+	if cf := loadConfigFile(filepath.Join(dir, "gb.cfg")); cf != nil {
+		for key, value := range cf.cfg {
+			cfg[key] = value
+		}
+		for key, source := range cf.sources {
+			sources[key] = source
+		}
+	}
 
-		br := bufio.NewReader(fin)
+	oneLiner("target", filepath.Join(dir, "target.gb"), cfg, sources)
+	oneLiner("workspace", filepath.Join(dir, "workspace.gb"), cfg, sources)
 
-		for {
-			line, isPrefix, brerr := br.ReadLine()
-			if brerr != nil {
-				break
-			}
-			if isPrefix {
-				ErrLog.Println(errors.New(fmt.Sprintf("config line too long: %s", path)))
+	return
+}
+
+type configFile struct {
+	modTime time.Time
+	size    int64
+	cfg     Config
+	sources ConfigSources
+}
+
+// every gb.cfg parsed so far, by platform and absolute path, since each
+// platform may read it differently
+var configFiles = make(map[string]*configFile)
+
+// loadConfigFile parses the gb.cfg at path, or returns what it found the last
+// time if the file hasn't changed since, so that a gb.cfg that every
+// directory below inherits from is only parsed, and its problems only
+// reported, once. It returns nil if there is no such file.
+func loadConfigFile(path string) (cf *configFile) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ErrLog.Println(err)
+		}
+		return
+	}
+	key := GOOS + "_" + GOARCH + ":" + GetAbs(path, CWD)
+	if cf = configFiles[key]; cf != nil && cf.modTime.Equal(info.ModTime()) && cf.size == info.Size() {
+		return
+	}
+
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		ErrLog.Println(err)
+	}
+	cf = &configFile{modTime: info.ModTime(), size: info.Size()}
+	var errs []error
+	cf.cfg, cf.sources, errs = ParseConfig(path, text)
+	for _, err := range errs {
+		ErrLog.Println(err)
+	}
+	configFiles[key] = cf
+	return
+}
+
+// the keys that hold one value, which may be quoted, rather than a list of
+// words
+var singleValueKeys = map[string]bool{
+	"proto":       true,
+	"target":      true,
+	"workspace":   true,
+	"makefile":    true,
+	"ignore":      true,
+	"ignoreall":   true,
+	"pkgdir":      true,
+	"toolchain":   true,
+	"testtimeout": true,
+}
+
+// ParseConfig reads the text of the gb.cfg file at path. A # starts a comment,
+// unless it is quoted or in the middle of a word, and a \ at the end of a
+// line continues it on the next. Values are split into words first, and then
+// $GOOS, $GOARCH, $GBROOT (the workspace's directory) and other $NAME or
+// ${NAME} environment variables are expanded in each word, except between
+// single quotes, so a value with spaces stays in its word. $$ stands for $.
+// The value of a key that holds a single value may be quoted; the value of any
+// other key is kept as its words, quoted again where SplitQuoted needs it.
+// Every problem is reported, with its line, in errs.
+func ParseConfig(path string, text []byte) (cfg Config, sources ConfigSources, errs []error) {
+	cfg = make(Config)
+	sources = make(ConfigSources)
+
+	problem := func(lineno int, format string, args ...interface{}) {
+		errs = append(errs, errors.New(fmt.Sprintf("%s:%d: %s", path, lineno, fmt.Sprintf(format, args...))))
+	}
+
+	lines := strings.Split(string(text), "\n")
+	for i := 0; i < len(lines); i++ {
+		lineno := i + 1
+		line := strings.TrimRight(lines[i], " \t\r")
+		for strings.HasSuffix(line, "\\") {
+			if i+1 == len(lines) {
+				problem(lineno, "the file ends with a \\ continuation")
+				line = line[:len(line)-1]
 				break
 			}
+			i++
+			line = strings.TrimRight(line[:len(line)-1], " \t") + " " + strings.TrimSpace(lines[i])
+		}
 
-			line = bytes.TrimSpace(line)
-			if len(line) == 0 {
+		line = strings.TrimSpace(stripConfigComment(line))
+		if line == "" {
+			continue
+		}
+		source := fmt.Sprintf("%s:%d", path, lineno)
+
+		if line[0] == '!' {
+			key := strings.ToLower(strings.TrimSpace(line[1:]))
+			if !cascadingKeys[key] {
+				problem(lineno, "only inherited keys can be unset, not %q", key)
 				continue
 			}
+			// the later line wins
+			delete(cfg, key)
+			delete(sources, key)
+			cfg["!"+key] = ""
+			sources["!"+key] = source
+			continue
+		}
 
-			split := bytes.Index(line, []byte("="))
-			if split == -1 {
-				ErrLog.Println(errors.New(fmt.Sprintf("config line malformed: %s", path)))
-				break
+		split := strings.Index(line, "=")
+		if split == -1 {
+			problem(lineno, "expected key=value or !key, found %q", line)
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:split]))
+		value := strings.TrimSpace(line[split+1:])
+		if !knownKeys[key] && !strings.HasPrefix(key, "group.") {
+			problem(lineno, "unknown key %q", key)
+			continue
+		}
+		words, err := SplitQuotedExpand(value, expandConfigVar)
+		if err != nil {
+			problem(lineno, "%s: %v", key, err)
+			continue
+		}
+		if singleValueKeys[key] {
+			if len(words) > 1 {
+				problem(lineno, "%s takes a single value; quote it if it has spaces", key)
+				continue
 			}
-			key, val := line[:split], line[split+1:]
-			key = bytes.ToLower(bytes.TrimSpace(key))
-			val = bytes.TrimSpace(val)
-			cfg[string(key)] = string(val)
-			if !knownKeys[string(key)] {
-				ErrLog.Printf("Unknown key '%s' in config %s", key, path)
+			value = ""
+			if len(words) == 1 {
+				value = words[0]
+			}
+		} else {
+			for i, word := range words {
+				words[i] = quoteConfigWord(word, " \t\n\"'\\")
+			}
+			value = strings.Join(words, " ")
+		}
+		delete(cfg, "!"+key)
+		delete(sources, "!"+key)
+		cfg[key] = value
+		sources[key] = source
+	}
+	return
+}
+
+// stripConfigComment removes a # comment from the end of a line.
+func stripConfigComment(line string) string {
+	var quote rune
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
 			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
 		}
 	}
+	return line
+}
 
-	oneLiner("target", filepath.Join(dir, "target.gb"), cfg)
-	oneLiner("workspace", filepath.Join(dir, "workspace.gb"), cfg)
+var configVar = regexp.MustCompile(`^\$(\$|[A-Za-z_][A-Za-z0-9_]*|\{[^}]*\}?)`)
 
+// expandConfigVar gives the value of the gb.cfg variable text starts with,
+// and its length. n is zero if there is no variable there.
+func expandConfigVar(text string) (value string, n int, err error) {
+	v := configVar.FindString(text)
+	if v == "" {
+		return
+	}
+	n = len(v)
+	name := v[1:]
+	if strings.HasPrefix(name, "{") {
+		if !strings.HasSuffix(name, "}") || len(name) == 2 {
+			err = errors.New(fmt.Sprintf("malformed variable %q", v))
+			return
+		}
+		name = name[1 : len(name)-1]
+	}
+	switch name {
+	case "$":
+		value = "$"
+	case "GOOS":
+		value = GOOS
+	case "GOARCH":
+		value = GOARCH
+	case "GBROOT":
+		value = CWD
+	default:
+		value = os.Getenv(name)
+	}
+	return
+}
+
+// quoteConfigWord puts word in single quotes if it is empty or holds any of
+// the special characters.
+func quoteConfigWord(word, special string) string {
+	if word != "" && !strings.ContainsAny(word, special) {
+		return word
+	}
+	return "'" + strings.Replace(word, "'", `'"'"'`, -1) + "'"
+}
+
+// PrintConfig prints the target's effective configuration, and the file and
+// line each setting came from.
+func (this *Package) PrintConfig() {
+	label := "pkg"
+	if this.IsCmd {
+		label = "cmd"
+	}
+	fmt.Printf("%s \"%s\" in %s\n", label, this.Target, this.Dir)
+
+	var keys []string
+	for key := range this.Cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 {
+		fmt.Printf(" (no settings)\n")
+	}
+	for _, key := range keys {
+		source := this.CfgSources[key]
+		if source == "" {
+			source = "gb"
+		}
+		fmt.Printf(" %s=%s (from %s)\n", key, this.Cfg[key], source)
+	}
+}
+
+// EffectiveConfig gives the configuration of a directory in the workspace:
+// the inherited keys from the gb.cfg files of the directories above it, from
+// the workspace down, overridden or unset by each directory in turn. Keys that
+// describe a single directory, like target, are only taken from its own
+// gb.cfg, as is everything for a directory outside the workspace.
+func EffectiveConfig(dir string) (cfg Config, sources ConfigSources) {
+	cfg = make(Config)
+	sources = make(ConfigSources)
+
+	chain := []string{dir}
+	if rel := GetRelative(CWD, GetAbs(dir, CWD), CWD); !filepath.IsAbs(rel) && !HasPathPrefix(rel, "..") {
+		chain = nil
+		for d := rel; ; d = filepath.Dir(d) {
+			chain = append([]string{d}, chain...)
+			if d == "." {
+				break
+			}
+		}
+	}
+
+	for i, d := range chain {
+		own, ownSources := ReadConfigSources(d)
+		for key, value := range own {
+			if strings.HasPrefix(key, "!") {
+				delete(cfg, key[1:])
+				delete(sources, key[1:])
+				continue
+			}
+			if i != len(chain)-1 && !cascadingKeys[key] {
+				continue
+			}
+			cfg[key] = value
+			sources[key] = ownSources[key]
+		}
+	}
 	return
 }
@@ -0,0 +1,163 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+)
+
+// tags from the command line (--tags), in addition to GOOS, GOARCH and cgo
+var BuildTags []string
+
+// SplitTags splits a list of tags separated by spaces or commas.
+func SplitTags(list string) (tags []string) {
+	return strings.FieldsFunc(list, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
+func validTag(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchTag reports whether a single, possibly negated, tag is satisfied by
+// the current GOOS and GOARCH (and the unix, posix and bsd groups), by cgo
+// being available, or by one of tags.
+func MatchTag(name string, tags []string) bool {
+	if strings.HasPrefix(name, "!") {
+		name = name[1:]
+		return validTag(name) && !MatchTag(name, tags)
+	}
+	if !validTag(name) {
+		return false
+	}
+	if CheckCGOFlag(name) {
+		return true
+	}
+	if name == "cgo" {
+		return CGoCMD != ""
+	}
+	for _, tag := range tags {
+		if tag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTagExpr evaluates one space-separated term of a build constraint:
+// a comma-separated list of tags that must all match.
+func MatchTagExpr(expr string, tags []string) bool {
+	if expr == "" {
+		return false
+	}
+	for _, name := range strings.Split(expr, ",") {
+		if !MatchTag(name, tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchConstraint evaluates the text following "+build": it is satisfied if
+// any of its space-separated terms is.
+func MatchConstraint(line string, tags []string) bool {
+	for _, expr := range strings.Fields(line) {
+		if MatchTagExpr(expr, tags) {
+			return true
+		}
+	}
+	return false
+}
+
+// ShouldBuild checks the "// +build" lines of a source file. They are only
+// honored in the run of // comments and blank lines at the top of the file,
+// which must end with a blank line, and all of them must be satisfied.
+func ShouldBuild(content []byte, tags []string) bool {
+	slashslash := []byte("//")
+
+	end := 0
+	p := content
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, p = line[:i], p[i+1:]
+		} else {
+			p = p[len(p):]
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			end = len(content) - len(p)
+			continue
+		}
+		if !bytes.HasPrefix(line, slashslash) {
+			break
+		}
+	}
+	content = content[:end]
+
+	p = content
+	for len(p) > 0 {
+		line := p
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, p = line[:i], p[i+1:]
+		} else {
+			p = p[len(p):]
+		}
+		line = bytes.TrimSpace(line)
+		if !bytes.HasPrefix(line, slashslash) {
+			continue
+		}
+		line = bytes.TrimSpace(line[len(slashslash):])
+		if len(line) == 0 || line[0] != '+' {
+			continue
+		}
+		fields := strings.Fields(string(line))
+		if fields[0] == "+build" && !MatchConstraint(strings.Join(fields[1:], " "), tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// ShouldBuildFile reads a .go, .c or .s file and checks its build constraints.
+func ShouldBuildFile(fpath string, tags []string) bool {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		return true
+	}
+	return ShouldBuild(content, tags)
+}
+
+// BuildTags are the tags in effect for the target's source files.
+func (this *Package) BuildTags() (tags []string) {
+	tags = append(tags, BuildTags...)
+	if cfgTags, set := this.Cfg.Tags(); set {
+		tags = append(tags, cfgTags...)
+	}
+	return
+}
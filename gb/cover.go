@@ -0,0 +1,457 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"html"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// where the instrumented copies of a package's sources go, and where its
+// test binary leaves the counters, both relative to the package's directory
+var CoverDir = filepath.Join("_test", "_cover_")
+var CoverCounts = filepath.Join("_test", "_cover_.out")
+
+// A CoverBlock is a run of statements that are always executed together.
+// Lines and columns are 1-based and refer to the original source.
+type CoverBlock struct {
+	Line0, Col0, Line1, Col1 int
+	Stmts                    int
+	Count                    int
+}
+
+type CoverFile struct {
+	// the source, relative to the package's directory
+	Name string
+	// the counter variable added to the instrumented copy
+	Var    string
+	Blocks []CoverBlock
+}
+
+// A CoverProfile holds the coverage of one target by its tests.
+type CoverProfile struct {
+	Target, Dir string
+	Files       []*CoverFile
+}
+
+func (this *CoverProfile) Statements() (total, covered int) {
+	for _, cf := range this.Files {
+		for _, block := range cf.Blocks {
+			total += block.Stmts
+			if block.Count != 0 {
+				covered += block.Stmts
+			}
+		}
+	}
+	return
+}
+
+func Percent(covered, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(covered) / float64(total)
+}
+
+// endsBlock tells if control may leave a statement some other way than by
+// falling through to the next one.
+func endsBlock(stmt ast.Stmt) bool {
+	switch s := stmt.(type) {
+	case *ast.IfStmt, *ast.ForStmt, *ast.RangeStmt, *ast.SwitchStmt,
+		*ast.TypeSwitchStmt, *ast.SelectStmt, *ast.BlockStmt,
+		*ast.ReturnStmt, *ast.BranchStmt:
+		return true
+	case *ast.LabeledStmt:
+		return endsBlock(s.Stmt)
+	}
+	return false
+}
+
+// blockEnd is where a block ending with stmt stops, which is before the body
+// of a compound statement so that the body's blocks don't overlap it.
+func blockEnd(stmt ast.Stmt) token.Pos {
+	switch s := stmt.(type) {
+	case *ast.IfStmt:
+		return s.Body.Lbrace
+	case *ast.ForStmt:
+		return s.Body.Lbrace
+	case *ast.RangeStmt:
+		return s.Body.Lbrace
+	case *ast.SwitchStmt:
+		return s.Body.Lbrace
+	case *ast.TypeSwitchStmt:
+		return s.Body.Lbrace
+	case *ast.SelectStmt:
+		return s.Body.Lbrace
+	case *ast.BlockStmt:
+		return s.Lbrace
+	case *ast.LabeledStmt:
+		return blockEnd(s.Stmt)
+	}
+	return stmt.End()
+}
+
+// InstrumentFile sets an element of counter's Count array at the start of
+// every block of statements in src, and declares counter at the end. Nothing
+// is inserted across lines, so line numbers in the copy stay the same.
+func InstrumentFile(name string, src []byte, counter string) (out []byte, blocks []CoverBlock, err error) {
+	fset := token.NewFileSet()
+	var file *ast.File
+	if file, err = parser.ParseFile(fset, name, src, 0); err != nil {
+		return
+	}
+
+	var offsets []int
+	addList := func(list []ast.Stmt) {
+		for start := 0; start < len(list); {
+			end := start
+			for {
+				end++
+				if end == len(list) || endsBlock(list[end-1]) {
+					break
+				}
+				// a label can be jumped to, so it starts a new block
+				if _, ok := list[end].(*ast.LabeledStmt); ok {
+					break
+				}
+			}
+			p0 := fset.Position(list[start].Pos())
+			p1 := fset.Position(blockEnd(list[end-1]))
+			offsets = append(offsets, p0.Offset)
+			blocks = append(blocks, CoverBlock{
+				Line0: p0.Line,
+				Col0:  p0.Column,
+				Line1: p1.Line,
+				Col1:  p1.Column,
+				Stmts: end - start,
+			})
+			start = end
+		}
+	}
+
+	// the bodies of switches and selects hold clauses, not statements
+	clauses := make(map[*ast.BlockStmt]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.SwitchStmt:
+			clauses[n.Body] = true
+		case *ast.TypeSwitchStmt:
+			clauses[n.Body] = true
+		case *ast.SelectStmt:
+			clauses[n.Body] = true
+		case *ast.BlockStmt:
+			if !clauses[n] {
+				addList(n.List)
+			}
+		case *ast.CaseClause:
+			addList(n.Body)
+		case *ast.CommClause:
+			addList(n.Body)
+		}
+		return true
+	})
+
+	// blocks are found outside in, so put them back in source order
+	sort.Sort(byOffset{offsets, blocks})
+
+	var buf bytes.Buffer
+	last := 0
+	for i, offset := range offsets {
+		buf.Write(src[last:offset])
+		fmt.Fprintf(&buf, "%s.Count[%d] = 1; ", counter, i)
+		last = offset
+	}
+	buf.Write(src[last:])
+	fmt.Fprintf(&buf, "\n\nvar %s struct {\n\tCount [%d]uint32\n}\n", counter, len(blocks))
+	out = buf.Bytes()
+	return
+}
+
+type byOffset struct {
+	offsets []int
+	blocks  []CoverBlock
+}
+
+func (p byOffset) Len() int           { return len(p.offsets) }
+func (p byOffset) Less(i, j int) bool { return p.offsets[i] < p.offsets[j] }
+func (p byOffset) Swap(i, j int) {
+	p.offsets[i], p.offsets[j] = p.offsets[j], p.offsets[i]
+	p.blocks[i], p.blocks[j] = p.blocks[j], p.blocks[i]
+}
+
+// InstrumentCover writes instrumented copies of srcs into CoverDir, and
+// returns their names relative to the package's directory.
+func (this *Package) InstrumentCover(srcs []string) (profile *CoverProfile, coverSrcs []string, err error) {
+	profile = &CoverProfile{
+		Target: this.Target,
+		Dir:    this.Dir,
+	}
+	if err = Exec.MkdirAll(filepath.Join(this.Dir, CoverDir)); err != nil {
+		return
+	}
+	for i, src := range srcs {
+		var data []byte
+		if data, err = ioutil.ReadFile(filepath.Join(this.Dir, src)); err != nil {
+			return
+		}
+		cf := &CoverFile{
+			Name: src,
+			Var:  fmt.Sprintf("GbCover_%d", i),
+		}
+		var out []byte
+		if out, cf.Blocks, err = InstrumentFile(src, data, cf.Var); err != nil {
+			return
+		}
+		// keep the positions in compile errors and panics pointing at the
+		// original source
+		out = append([]byte(fmt.Sprintf("//line %s:1\n", GetAbs(filepath.Join(this.Dir, src), CWD))), out...)
+		coverSrc := filepath.Join(CoverDir, src)
+		if err = WriteFile(filepath.Join(this.Dir, coverSrc), out, 0644); err != nil {
+			return
+		}
+		profile.Files = append(profile.Files, cf)
+		coverSrcs = append(coverSrcs, coverSrc)
+	}
+	return
+}
+
+// ReadCounts reads the counters the test binary wrote, one
+// "<source> <block> <count>" line for each block.
+func (this *CoverProfile) ReadCounts(p string) (err error) {
+	var fin *os.File
+	fin, err = os.Open(p)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	files := make(map[string]*CoverFile)
+	for _, cf := range this.Files {
+		files[cf.Name] = cf
+	}
+
+	br := bufio.NewReader(fin)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			err = errors.New(fmt.Sprintf("coverage counts malformed: %s", p))
+			return
+		}
+		cf := files[fields[0]]
+		index, ierr := strconv.Atoi(fields[1])
+		count, cerr := strconv.Atoi(fields[2])
+		if cf == nil || ierr != nil || cerr != nil || index < 0 || index >= len(cf.Blocks) {
+			err = errors.New(fmt.Sprintf("coverage counts malformed: %s", p))
+			return
+		}
+		cf.Blocks[index].Count = count
+	}
+	return
+}
+
+var coverProfiles []*CoverProfile
+var coverProfilesLock sync.Mutex
+
+func RecordCoverProfile(profile *CoverProfile) {
+	coverProfilesLock.Lock()
+	coverProfiles = append(coverProfiles, profile)
+	coverProfilesLock.Unlock()
+}
+
+type byProfileTarget []*CoverProfile
+
+func (p byProfileTarget) Len() int           { return len(p) }
+func (p byProfileTarget) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byProfileTarget) Less(i, j int) bool { return p[i].Target < p[j].Target }
+
+// WriteProfile writes the profile in the format of "go tool cover", naming
+// each source by its target.
+func (this *CoverProfile) WriteProfile(w io.Writer) {
+	for _, cf := range this.Files {
+		for _, block := range cf.Blocks {
+			fmt.Fprintf(w, "%s/%s:%d.%d,%d.%d %d %d\n", this.Target, cf.Name,
+				block.Line0, block.Col0, block.Line1, block.Col1, block.Stmts, block.Count)
+		}
+	}
+}
+
+func CoverProfilePath(target string) string {
+	return filepath.Join(GetBuildDirPkg(), "cover", target+".out")
+}
+
+// WriteCoverage writes a profile for each target tested during the run and
+// one for the whole workspace, prints how much of each target was covered and
+// writes the HTML report if one was asked for.
+func WriteCoverage() (err error) {
+	if !Cover {
+		return
+	}
+
+	coverProfilesLock.Lock()
+	profiles := coverProfiles
+	coverProfilesLock.Unlock()
+	sort.Sort(byProfileTarget(profiles))
+
+	var all bytes.Buffer
+	all.WriteString("mode: set\n")
+	allTotal, allCovered := 0, 0
+	for _, profile := range profiles {
+		var buf bytes.Buffer
+		buf.WriteString("mode: set\n")
+		profile.WriteProfile(&buf)
+		profile.WriteProfile(&all)
+
+		p := CoverProfilePath(profile.Target)
+		if err = Exec.MkdirAll(filepath.Dir(p)); err != nil {
+			return
+		}
+		if err = WriteFile(p, buf.Bytes(), 0644); err != nil {
+			return
+		}
+
+		total, covered := profile.Statements()
+		allTotal += total
+		allCovered += covered
+		fmt.Printf("coverage: %.1f%% of statements in \"%s\"\n", Percent(covered, total), profile.Target)
+	}
+	fmt.Printf("coverage: %.1f%% of statements in total\n", Percent(allCovered, allTotal))
+
+	p := filepath.Join(GetBuildDirPkg(), "cover.out")
+	if err = WriteFile(p, all.Bytes(), 0644); err != nil {
+		return
+	}
+	fmt.Printf("Wrote coverage profile to %s\n", p)
+
+	if CoverHTML != "" {
+		if err = WriteCoverHTML(CoverHTML, profiles); err != nil {
+			return
+		}
+		fmt.Printf("Wrote coverage report to %s\n", CoverHTML)
+	}
+	return
+}
+
+// WriteCoverHTML writes every source in profiles with its covered blocks in
+// green and its uncovered ones in red.
+func WriteCoverHTML(p string, profiles []*CoverProfile) (err error) {
+	var buf bytes.Buffer
+	buf.WriteString(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>gb coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #111; color: #888; padding: 1em; }
+.cov0 { color: #e05050; }
+.cov1 { color: #50d050; }
+</style>
+</head>
+<body>
+`)
+	for _, profile := range profiles {
+		for _, cf := range profile.Files {
+			var src []byte
+			if src, err = ioutil.ReadFile(filepath.Join(profile.Dir, cf.Name)); err != nil {
+				return
+			}
+			total, covered := 0, 0
+			for _, block := range cf.Blocks {
+				total += block.Stmts
+				if block.Count != 0 {
+					covered += block.Stmts
+				}
+			}
+			fmt.Fprintf(&buf, "<h2>%s/%s: %.1f%%</h2>\n<pre>", html.EscapeString(profile.Target),
+				html.EscapeString(cf.Name), Percent(covered, total))
+			writeCoverSource(&buf, src, cf.Blocks)
+			buf.WriteString("</pre>\n")
+		}
+	}
+	buf.WriteString("</body>\n</html>\n")
+
+	err = WriteFile(p, buf.Bytes(), 0644)
+	return
+}
+
+func writeCoverSource(buf *bytes.Buffer, src []byte, blocks []CoverBlock) {
+	lineStarts := []int{0}
+	for i, c := range src {
+		if c == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+	offset := func(line, col int) int {
+		if line < 1 || line > len(lineStarts) {
+			return len(src)
+		}
+		o := lineStarts[line-1] + col - 1
+		if o > len(src) {
+			o = len(src)
+		}
+		return o
+	}
+
+	// blocks come in source order, so an inner block is painted after the
+	// statement that holds it
+	class := make([]string, len(src))
+	for _, block := range blocks {
+		c := "cov0"
+		if block.Count != 0 {
+			c = "cov1"
+		}
+		for i := offset(block.Line0, block.Col0); i < offset(block.Line1, block.Col1); i++ {
+			class[i] = c
+		}
+	}
+
+	for start := 0; start < len(src); {
+		end := start + 1
+		for end < len(src) && class[end] == class[start] {
+			end++
+		}
+		text := html.EscapeString(string(src[start:end]))
+		if class[start] == "" {
+			buf.WriteString(text)
+		} else {
+			fmt.Fprintf(buf, "<span class=\"%s\">%s</span>", class[start], text)
+		}
+		start = end
+	}
+}
@@ -17,35 +17,55 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"errors"
+	"fmt"
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"regexp"
 	"strings"
 )
 
-func GetDeps(source string) (pkg, target string, deps, funcs, cflags, ldflags []string, err error) {
+// GetImports lists the imports of a source file.
+func GetImports(source string) (deps []string, err error) {
+	file, err := parser.ParseFile(token.NewFileSet(), source, nil, parser.ImportsOnly)
+	if err != nil {
+		return
+	}
+	for _, spec := range file.Imports {
+		deps = append(deps, spec.Path.Value)
+	}
+	return
+}
+
+// GetDeps scans a source file for its package name, its imports, its
+// "// target:" comment and, if tags satisfy their constraints, the flags of
+// its #cgo directives. In tests, it also finds the functions and examples.
+func GetDeps(source string, tags []string) (pkg, target string, deps, funcs, cflags, ldflags, pkgconfig []string, examples []TestExample, err error) {
 	isTest := strings.HasSuffix(source, "_test.go") && Test
 	var file *ast.File
 	flag := parser.ParseComments
 	if !isTest {
 		flag = flag | parser.ImportsOnly
 	}
-	file, err = parser.ParseFile(token.NewFileSet(), source, nil, flag)
+	fset := token.NewFileSet()
+	file, err = parser.ParseFile(fset, source, nil, flag)
 	if err != nil {
 		return
 	}
 
 	w := &Walker{
-		Name:       "",
-		Target:     "",
-		pkgPos:     0,
-		Deps:       []string{},
-		Funcs:      []string{},
-		CGoLDFlags: []string{},
-		CGoCFlags:  []string{},
-		ScanFuncs:  isTest,
+		Name:         "",
+		Target:       "",
+		pkgPos:       0,
+		Deps:         []string{},
+		Funcs:        []string{},
+		CGoLDFlags:   []string{},
+		CGoCFlags:    []string{},
+		CGoPkgConfig: []string{},
+		ScanFuncs:    isTest,
+		Tags:         tags,
+		fset:         fset,
 	}
 
 	ast.Walk(w, file)
@@ -56,6 +76,8 @@ func GetDeps(source string) (pkg, target string, deps, funcs, cflags, ldflags []
 	funcs = w.Funcs
 	cflags = RemoveDups(w.CGoCFlags)
 	ldflags = RemoveDups(w.CGoLDFlags)
+	pkgconfig = RemoveDups(w.CGoPkgConfig)
+	examples = w.Examples
 
 	return
 }
@@ -73,14 +95,115 @@ func RemoveDups(list []string) (newlist []string) {
 }
 
 type Walker struct {
-	Name       string
-	Target     string
-	pkgPos     token.Pos
-	Deps       []string
-	Funcs      []string
-	CGoLDFlags []string
-	CGoCFlags  []string
-	ScanFuncs  bool
+	Name         string
+	Target       string
+	pkgPos       token.Pos
+	Deps         []string
+	Funcs        []string
+	CGoLDFlags   []string
+	CGoCFlags    []string
+	CGoPkgConfig []string
+	ScanFuncs    bool
+	Examples     []TestExample
+	// the tags #cgo directives are matched against
+	Tags     []string
+	comments []*ast.CommentGroup
+	fset     *token.FileSet
+}
+
+// the comment that ends an example whose output is checked
+var outputPrefix = regexp.MustCompile(`(?i)^[[:space:]]*(unordered )?output:`)
+
+// ExampleOutput finds the output an example expects, which is given in a
+// final "// Output:" comment in its body. An example without one is only
+// compiled, not run.
+func ExampleOutput(fdecl *ast.FuncDecl, comments []*ast.CommentGroup) (output string, unordered, ok bool) {
+	if fdecl.Body == nil {
+		return
+	}
+	var last *ast.CommentGroup
+	for _, cg := range comments {
+		if cg.Pos() > fdecl.Body.Lbrace && cg.End() < fdecl.Body.Rbrace {
+			last = cg
+		}
+	}
+	if last == nil {
+		return
+	}
+	text := last.Text()
+	loc := outputPrefix.FindStringSubmatchIndex(text)
+	if loc == nil {
+		return
+	}
+	unordered = loc[2] != -1
+	output = strings.TrimLeft(text[loc[1]:], " ")
+	if strings.HasPrefix(output, "\n") {
+		output = output[1:]
+	}
+	ok = true
+	return
+}
+
+// ParseCgoDirective splits a "#cgo [constraint] VAR: value" line into its
+// parts. The constraint uses the grammar of +build lines.
+func ParseCgoDirective(line string) (constraint, verb, value string, err error) {
+	text := strings.TrimSpace(line[len("#cgo"):])
+	colon := strings.Index(text, ":")
+	if colon == -1 {
+		err = errors.New(fmt.Sprintf("malformed #cgo directive %q, expected \"#cgo [constraint] VAR: value\"", line))
+		return
+	}
+	fields := strings.Fields(text[:colon])
+	if len(fields) == 0 {
+		err = errors.New(fmt.Sprintf("malformed #cgo directive %q, expected \"#cgo [constraint] VAR: value\"", line))
+		return
+	}
+	verb = fields[len(fields)-1]
+	constraint = strings.Join(fields[:len(fields)-1], " ")
+	value = strings.TrimSpace(text[colon+1:])
+
+	switch verb {
+	case "CFLAGS", "CPPFLAGS", "LDFLAGS", "pkg-config":
+	default:
+		err = errors.New(fmt.Sprintf("unknown #cgo variable %q in %q, expected CFLAGS, CPPFLAGS, LDFLAGS or pkg-config", verb, line))
+		return
+	}
+	for _, expr := range fields[:len(fields)-1] {
+		for _, name := range strings.Split(expr, ",") {
+			if strings.HasPrefix(name, "!") {
+				name = name[1:]
+			}
+			if !validTag(name) {
+				err = errors.New(fmt.Sprintf("malformed constraint %q in #cgo directive %q", expr, line))
+				return
+			}
+		}
+	}
+	return
+}
+
+// cgoDirective records the flags of a #cgo line found at pos, if its
+// constraint is satisfied.
+func (w *Walker) cgoDirective(line string, pos token.Position) {
+	if line != "#cgo" && !strings.HasPrefix(line, "#cgo ") && !strings.HasPrefix(line, "#cgo\t") {
+		return
+	}
+	constraint, verb, value, err := ParseCgoDirective(line)
+	if err != nil {
+		WarnLog.Printf("%s:%d: %v", pos.Filename, pos.Line, err)
+		return
+	}
+	if constraint != "" && !MatchConstraint(constraint, w.Tags) {
+		return
+	}
+	switch verb {
+	case "CFLAGS", "CPPFLAGS":
+		w.CGoCFlags = append(w.CGoCFlags, value)
+	case "LDFLAGS":
+		w.CGoLDFlags = append(w.CGoLDFlags, value)
+	case "pkg-config":
+		w.CGoPkgConfig = append(w.CGoPkgConfig, strings.Fields(value)...)
+	}
 }
 
 func (w *Walker) Visit(node ast.Node) (v ast.Visitor) {
@@ -88,6 +211,7 @@ func (w *Walker) Visit(node ast.Node) (v ast.Visitor) {
 	case *ast.File:
 		w.Name = n.Name.Name
 		w.pkgPos = n.Package
+		w.comments = n.Comments
 		return w
 	case *ast.ImportSpec:
 		w.Deps = append(w.Deps, string(n.Path.Value))
@@ -108,61 +232,16 @@ func (w *Walker) Visit(node ast.Node) (v ast.Visitor) {
 				//w.Target = strings.TrimSpace(text[len("target:"):])
 			}
 		} else {
-
-			handleCommentLine := func(text string) {
-				if strings.HasPrefix(text, "#cgo") {
-					cgoMsg := strings.TrimSpace(text[len("#cgo"):])
-
-					fields := strings.Fields(cgoMsg)
-					if len(fields) >= 1 {
-						flag := fields[0]
-						if !strings.HasSuffix(flag, ":") {
-							if !CheckCGOFlag(flag) {
-								return
-							} else {
-								cgoMsg = strings.TrimSpace(cgoMsg[len(flag):])
-							}
-						}
-					}
-
-					cflags := false
-					lflags := false
-					if strings.HasPrefix(cgoMsg, "CFLAGS:") {
-						cflags = true
-						cgoMsg = strings.TrimSpace(cgoMsg[len("CFLAGS:"):])
-					} else if strings.HasPrefix(cgoMsg, "LDFLAGS:") {
-						lflags = true
-						cgoMsg = strings.TrimSpace(cgoMsg[len("LDFLAGS:"):])
-					}
-
-					if cflags {
-						w.CGoCFlags = append(w.CGoCFlags, cgoMsg)
-					}
-					if lflags {
-						w.CGoLDFlags = append(w.CGoLDFlags, cgoMsg)
-					}
-				}
-			}
-
+			pos := w.fset.Position(n.Pos())
 			text := string(n.Text)
 			if strings.HasPrefix(text, "//") {
-				text = strings.TrimSpace(text[2:])
-				handleCommentLine(text)
+				w.cgoDirective(strings.TrimSpace(text[2:]), pos)
 			} else if strings.HasPrefix(text, "/*") && strings.HasSuffix(text, "*/") {
-				text = strings.TrimSpace(text[2 : len(text)-2])
-				br := bufio.NewReader(bytes.NewBuffer([]byte(text)))
-				for {
-					line, isprefix, err := br.ReadLine()
-					if err != nil {
-						break
-					}
-					if isprefix {
-						ErrLog.Printf("Extra long comment ignored: %v", node.Pos())
-						return
-					}
-					lines := string(line)
-					lines = strings.TrimSpace(lines)
-					handleCommentLine(lines)
+				// each line is reported with its own line number
+				for i, line := range strings.Split(text[2:len(text)-2], "\n") {
+					linePos := pos
+					linePos.Line += i
+					w.cgoDirective(strings.TrimSpace(line), linePos)
 				}
 			}
 		}
@@ -172,6 +251,11 @@ func (w *Walker) Visit(node ast.Node) (v ast.Visitor) {
 			fdecl, ok := node.(*ast.FuncDecl)
 			if ok && fdecl.Recv == nil {
 				w.Funcs = append(w.Funcs, fdecl.Name.Name)
+				if strings.HasPrefix(fdecl.Name.Name, "Example") {
+					if output, unordered, ok := ExampleOutput(fdecl, w.comments); ok {
+						w.Examples = append(w.Examples, TestExample{fdecl.Name.Name, output, unordered})
+					}
+				}
 			}
 		}
 		return nil
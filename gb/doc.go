@@ -67,20 +67,51 @@ If gb is run within a directory that has a valid target, the target's name
 will be taken from the containing directory, rather than the relative path,
 ".".
 
+Packages and commands may both import "C". A command that uses cgo, or
+imports packages that do, and has #cgo LDFLAGS anywhere among them is linked
+with the system linker, which is given those flags. A "#cgo pkg-config: lib"
+line asks pkg-config for lib's CFLAGS and LDFLAGS, and a target whose .pc
+file pkg-config cannot find is reported as broken. A #cgo line may be guarded
+by a constraint written like those of +build lines, as in
+"#cgo linux,amd64 CFLAGS: -DX" or "#cgo !windows LDFLAGS: -lm", and gb warns
+about #cgo lines it cannot make sense of.
+
 gb will match target names with import statements found in the source to 
 determine the workspace dependency structure. It will use this structure to 
 do incremental building correctly.
 
-Packages are all built to the _obj directory in the root, and commands are 
-built to the bin directory in the root. If -i is on, they will be copied to 
-$GOROOT/pkg/$GOOS_$GOOARCH and $GOROOT/bin.
+To decide what needs rebuilding, gb records a fingerprint of each target's
+inputs in _obj/$GOOS_$GOARCH/.gbhash: the contents of its source files, the effective
+compiler and linker flags, the archives of its dependencies and the tools
+used to build it. A target is rebuilt whenever its fingerprint changes,
+even if file modification times suggest otherwise.
+
+Packages are all built to the _obj/$GOOS_$GOARCH directory in the root, and 
+commands are built to the _bin/$GOOS_$GOARCH directory in the root, so that 
+results for different platforms never get mixed up. If -i is on, they will be 
+copied to $GOROOT/pkg/$GOOS_$GOOARCH and $GOROOT/bin.
 
 
 gb.cfg
 
 If a directory has a file named "gb.cfg", gb will examine it for special
 settings. They are entered each on their own line, in the form "key=val".
-Currently valid keys are as follows.
+The proto, makefile, gcflags, pkgdir, tags and testtimeout keys also apply
+to every directory below, unless a gb.cfg further down sets them to
+something else, or unsets them with a line of the form "!key". The other
+keys only apply to their own directory. "gb --config" shows the settings
+of each target and the gb.cfg line each one came from.
+
+A "#" starts a comment that runs to the end of the line, unless it is quoted
+or in the middle of a word, and a line ending in "\" continues on the next.
+Values may be quoted with "double" or 'single' quotes, so a value with spaces
+can be given as pkgdir="my packages" or gcflags=-D "some path". $GOOS,
+$GOARCH, $GBROOT (the workspace's directory) and other environment
+variables, written $NAME or ${NAME}, are expanded, except between single
+quotes, and $$ stands for a single "$". A variable whose value has spaces
+stays in one word, as in pkgdir=$GBROOT/lib. Every line gb cannot make
+sense of is reported with its line number and skipped. Currently valid keys
+are as follows.
 
 workspace=<relative path>
   Running gb in the current directory will pretend the working directory
@@ -95,7 +126,39 @@ ignoreall=true
   Never try to build a package in this directory or any of its
   subdirectories.
 gcflags=<flag1> <flag2>...
-  Include these flags on the compile line.
+  Include these flags on the compile line. Quote a flag to keep its spaces.
+tags=<tag1> <tag2>...
+  Treat these tags as satisfied when evaluating +build lines, in addition
+  to the ones given with --tags.
+goos=<os1> <os2>...
+goarch=<arch1> <arch2>...
+  Only read from the workspace's gb.cfg. Add to the $GOOS and $GOARCH
+  values that gb knows about and recognizes in file and directory names.
+group.<name>=<os1> <os2>...
+  Only read from the workspace's gb.cfg. Make <name> match any of the listed
+  $GOOS values, or add them to one of the existing unix, posix or bsd
+  groups.
+toolchain=<6g|go|gccgo>
+  Only read from the workspace's gb.cfg. Build with this toolchain unless
+  another is given with --toolchain.
+testtimeout=<duration>
+  Kill this target's test binary if it runs for longer than the duration,
+  for example 30s or 5m, unless --test-timeout is given.
+
+.gbignore
+
+gb never looks in directories named _obj, _test, _cgo or _bin, or whose
+names start with a ".". A file named ".gbignore" in the workspace's root can
+keep gb out of other directories and files, using the patterns of a
+.gitignore. Blank lines and lines starting with "#" are skipped. A pattern
+without a "/", such as "vendor/" or "*_gen.go", matches a name at any depth,
+so it can add to the directory names that are always skipped. A pattern with
+a "/" in it, or starting with one, matches paths from the workspace's root,
+such as "/tools" or "docs/**", where "**" matches any number of
+directories. A pattern ending in "/" only matches directories, and a pattern
+starting with "!" brings back what an earlier one ignored, although, as with
+git, nothing inside an ignored directory can be brought back. gb reports
+each malformed pattern with its line number.
 
 
 Tips
@@ -103,10 +166,21 @@ Tips
 If your root contains a few packages and a few commands, but you only want 
 to install the packages, run gb -Pi.
 
-You can encode some information in file names. If a common value for $GOOS 
-or $GOARCH appears in the file name in the form of *_VALUE*.go, that file 
-will only be included if it matches $GOOS or $GOARCH. The flag *_unix*.go 
-will match any of the unix-based $GOOS options.
+A .go, .c or .s file can restrict the builds it takes part in with
+"// +build" lines among the comments at the top of the file, followed by a
+blank line. Each line lists alternatives separated by spaces, each of which
+is a comma-separated list of tags that must all be satisfied, and a tag may
+be negated with "!". A file is only built if every one of its +build lines
+is satisfied. $GOOS, $GOARCH, unix, posix, bsd, cgo (if cgo is available)
+and any tags given with --tags or a gb.cfg tags= key are satisfied. Files
+excluded this way are listed as unused by gb -L.
+
+You can encode some information in file names. A file named
+*_GOOS_GOARCH.go, *_GOOS.go or *_GOARCH.go (optionally followed by _test)
+will only be included if it matches $GOOS and $GOARCH. In place of GOOS,
+unix, posix and bsd match any of the $GOOS options in that group. Names
+such as my_linuxutil.go are not affected. The same rules apply to .c, .s
+and other source files, and to the components of a target's directory.
 
 Quickly check the build status of any target with gb -s. It will print out 
 a list of targets, and will tell you if they are up to date or installed 
@@ -129,7 +203,8 @@ Options:
  -i		Install build pkgs and cmds to $GOROOT/pkg/$GOOS_$GOARCH and
 		$GOROOT/bin, respectively.
 
- -c		Remove all intermediate binaries.
+ -c		Remove all intermediate binaries for the current $GOOS and
+		$GOARCH.
 
  -N     Remove all installed binaries.
 
@@ -144,7 +219,12 @@ Options:
         repository.
 
  -p		Attempt to build a package immediately once its dependencies are
-		met and a processor is free.
+		met and a processor is free. A target whose dependencies failed
+		to build is skipped, but unrelated targets are still built.
+
+ -j <n>	Same as "-p", but run at most n compilers, linkers, test binaries
+		and other tools at once, and build at most n targets at once. By
+		default, n is the number of CPUs.
 
  -s		List all targets that are relevant to the current build plan. If
 		no directories are listed on the command line, all targets found
@@ -158,12 +238,32 @@ Options:
 		targets. Behaves similarly to "make test". All additional
 		command line arguments beginning with "-test." are passed to the
 		test binary (see http://golang.org/cmd/gotest for details).
+		Example functions ending in an "// Output:" comment are run and
+		their output checked, and if the tests define TestMain(m), it is
+		called instead of running the tests directly (this needs the "go"
+		toolchain, and TestMain must hand what m.Run returns to os.Exit).
+		With "-p" or "-j", the tests of different targets are built and
+		run at the same time, and each target's output is printed once its
+		tests are done. Test sources may import "C"; their cgo code is built
+		with the package's own, and cgo packages are tested without a
+		makefile.
 
  -e		Exclusive target list. Do not attempt to build any packages that
 		aren't in the directories listed on the command line.
 
  -v		Verbose. Print out all build instructions used.
 
+ -n		Dry run. Print, in the order they would happen, the commands gb
+		would run, each as "(in <dir>) <command> <args>", and the files and
+		directories it would write or remove, as "write", "mkdir -p",
+		"rm -f", "rm -rf" and "mv -f" lines, without running, writing or
+		removing anything. This works with building, testing, cleaning,
+		installing and the -- style commands. Targets are built one at a
+		time, even with -p. pkg-config and "go list", which only report on
+		the system, still run, since their answers decide the commands.
+		A target that imports one that would be rebuilt is shown as rebuilt
+		too. It cannot be used with --watch or --serve.
+
  -m		Use makefiles. If this flag is set, and a target contains a
 		makefile, that makefile will be used to build.
 
@@ -198,10 +298,120 @@ Options:
  --gofmt
  		Run gofmt on all source for relevant targets.
 
+ --graph
+ 		Print the dependency graph of the listed targets (or of every
+ 		target, if none are listed) in Graphviz DOT format, for example
+ 		"gb --graph | dot -Tpng > deps.png". Commands, packages, cgo and
+ 		protobuf targets are coloured differently, testdata targets have
+ 		dashed borders, and imports made only by tests are dashed edges.
+ 		Imports satisfied from GOROOT or by goinstall are drawn as
+ 		separate ellipses.
+
+ --graph-depth=<n>
+ 		With "--graph", only include targets at most n imports away from
+ 		a listed target.
+
+ --config
+ 		Print the gb.cfg settings in effect for each listed target,
+ 		including the ones inherited from the directories above, and
+ 		the file and line that each value came from.
+
+ --why <dir-or-target>
+ 		Explain why the target, named either by its directory or its
+ 		target name, would be rebuilt, or say that it is up to date.
+ 		Each reason is an input that differs from the fingerprint of the
+ 		last build, such as "source m.go changed since the last build" or
+ 		"dependency \"y\" rebuilt", or, for a target built before gb kept
+ 		fingerprints, a file newer than the result, such as "source m.go
+ 		newer than _obj/linux_amd64/x.a". A dependency that would be
+ 		rebuilt is followed by its own reasons, indented. gb also says why
+ 		-i would install the target. It may be combined with -g and -G.
+
+ --platforms <os1/arch1,os2/arch2...>
+ 		Build for each listed $GOOS/$GOARCH pair in turn, for example
+ 		"--platforms linux/amd64,linux/386,linux/arm". For each platform
+ 		the workspace is scanned again with that platform's file and
+ 		directory filtering, and built into its own _obj/$GOOS_$GOARCH
+ 		and _bin/$GOOS_$GOARCH. A summary of the targets built and broken
+ 		for each platform is printed at the end.
+
+ --toolchain <name>
+ 		Build with the named toolchain instead of the first one found.
+ 		"6g" runs 6g, 8g or 5g, 6a, 6l, 6c and gopack. "go" runs "go tool
+ 		compile", "go tool asm", "go tool pack", "go tool link" and "go
+ 		tool cgo" from a current Go installation, and finds the standard
+ 		library with "go list -export". "gccgo" compiles with gccgo,
+ 		builds each package to lib<name>.a and packs with ar; it cannot
+ 		build targets with .s files. Without this option or a toolchain=
+ 		key in the workspace's gb.cfg, "6g" is used if it can be found for
+ 		$GOARCH, and "go" otherwise.
+
+ --tags <tag1,tag2...>
+ 		Treat these tags as satisfied when evaluating +build lines.
+
+ --json
+ 		With "-s", "-S" or "-L", print each target as a single line of
+ 		JSON instead of text. Each object lists the target's name,
+ 		directory, kind, imports, resolved workspace dependencies,
+ 		source files, result and install paths, and whether it needs to
+ 		be built or installed.
+
  --make-a-mess
  		Do not clean up intermediate files, such as .6/.8, the _cgo
  		directory and the _test directory.
 
+ --cover
+ 		With "-t", measure which statements of each target its tests run.
+ 		The sources are instrumented in _test/_cover_, and the results are
+ 		written, in the format read by "go tool cover", to
+ 		<target>.out in the cover directory of the package build directory,
+ 		and for all targets together to cover.out beside it. The share of
+ 		statements covered is printed for each target and in total. Like
+ 		TestMain, this needs the "go" toolchain.
+
+ --cover-html <path>
+ 		Same as "--cover", and also write the sources of the tested targets
+ 		to path as HTML, with the covered statements in green and the
+ 		others in red.
+
+ --test-report <junit|tap>:<path>
+ 		With "-t", write the result of every test to path, as JUnit XML
+ 		or TAP, for example "--test-report=junit:tests.xml". Each
+ 		package is a test suite named after its target, and test binaries
+ 		are run with -test.v so that passing tests are listed too. A
+ 		package whose tests fail to build is reported as an error.
+
+ --test-timeout <duration>
+ 		With "-t", kill any test binary that runs for longer than the
+ 		duration, for example 30s or 5m, and report its target as failed.
+ 		This overrides testtimeout= in the targets' gb.cfg files.
+
+ --watch[=<interval>]
+ 		After building, keep watching the workspace for source files
+ 		that are created, modified or deleted, checking every second or
+ 		every interval, such as 500ms. On a change, only the changed
+ 		directories are scanned again, and the listed targets they
+ 		affect, along with the targets that import them, are rebuilt,
+ 		and retested with "-t". A status line follows each rebuild. If
+ 		a target appears, vanishes or changes its name or gb.cfg, the
+ 		whole workspace is scanned again. --watch cannot be used with
+ 		-- style commands, -c, -N, -s, -i or --platforms.
+
+ --serve <socket>
+ 		Scan the workspace once and keep it in memory, answering
+ 		requests from editors and other tools on the unix socket. Each
+ 		request is a line of JSON, such as {"Op":"build","Target":"foo"},
+ 		and is answered by a line of JSON. The ops are "targets" (the
+ 		listed targets), "target" (the target of a File), "deps" and
+ 		"rdeps" (what a Target imports, or what imports it, with "All"
+ 		to follow them all the way), "build" and "test" (a Target, with
+ 		what the tools printed in "Output"), "diagnostics" (build the
+ 		target of a File, and report the messages about it by line)
+ 		and "changed" (the targets affected by a list of Files). Before
+ 		each request the server rescans any directory whose source
+ 		changed, by modification time, or that holds one of the
+ 		request's Files. Failures are reported in "Error".
+
  --testargs
  		All command line arguments that follow --testargs will be
  		passed on to the test binaries, and otherwise ignored.
@@ -0,0 +1,314 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An Executor carries out everything gb does to the system: it runs the
+// external commands and creates, renames and removes files and directories.
+// Paths are relative to the workspace, unless absolute.
+type Executor interface {
+	// Run runs cmd with argv in the directory wd, killing it if it is still
+	// running after timeout. A timeout of zero waits forever.
+	Run(cmd, wd string, argv []string, stdout, stderr io.Writer, timeout time.Duration) (killed bool, err error)
+	MkdirAll(dir string) error
+	Remove(path string) error
+	RemoveAll(path string) error
+	Rename(from, to string) error
+	// Create opens path for writing, emptying it if it exists.
+	Create(path string, perm os.FileMode) (io.WriteCloser, error)
+	// Stat describes path as it is after everything done so far.
+	Stat(path string) (os.FileInfo, error)
+}
+
+// the executor gb goes through, which -n replaces with a DryRunExecutor
+var Exec Executor = RealExecutor{}
+
+// RealExecutor does what it is asked.
+type RealExecutor struct{}
+
+// a token for each command running, so that no more than Jobs compilers,
+// linkers, test binaries and other tools run at once, however many targets
+// are being built or tested
+var toolSlots chan bool
+var toolSlotsOnce sync.Once
+
+func (this RealExecutor) Run(cmd, wd string, argv []string, stdout, stderr io.Writer, timeout time.Duration) (killed bool, err error) {
+	toolSlotsOnce.Do(func() {
+		jobs := Jobs
+		if jobs < 1 {
+			jobs = 1
+		}
+		toolSlots = make(chan bool, jobs)
+	})
+	toolSlots <- true
+	defer func() {
+		<-toolSlots
+	}()
+
+	if Verbose {
+		fmt.Printf("%s\n", argv)
+	}
+
+	c := exec.Command(cmd, argv[1:]...)
+	c.Dir = wd
+	c.Env = os.Environ()
+
+	c.Stdout = stdout
+	c.Stderr = stderr
+
+	if err = c.Start(); err != nil {
+		return
+	}
+	if timeout == 0 {
+		err = c.Wait()
+	} else {
+		done := make(chan error, 1)
+		go func() {
+			done <- c.Wait()
+		}()
+		select {
+		case err = <-done:
+		case <-time.After(timeout):
+			c.Process.Kill()
+			<-done
+			killed = true
+			err = errors.New(fmt.Sprintf("%v: killed after %v", argv, timeout))
+			return
+		}
+	}
+
+	if wmsg, ok := err.(*exec.ExitError); ok {
+		if wmsg.ExitStatus() != 0 {
+			err = errors.New(fmt.Sprintf("%v: %s\n", argv, wmsg.String()))
+		} else {
+			err = nil
+		}
+	}
+	return
+}
+
+func (this RealExecutor) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (this RealExecutor) Remove(path string) error {
+	return os.Remove(path)
+}
+
+func (this RealExecutor) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (this RealExecutor) Rename(from, to string) error {
+	return os.Rename(from, to)
+}
+
+func (this RealExecutor) Create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	return os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+}
+
+func (this RealExecutor) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(path)
+}
+
+// DryRunExecutor prints, one line each, the commands it is asked to run and
+// the changes it is asked to make, in the form of shell commands, and does
+// none of them. It keeps track of what would have been created and removed,
+// so that, for instance, a clean followed by a build shows everything being
+// rebuilt.
+type DryRunExecutor struct {
+	lock             sync.Mutex
+	created, removed map[string]bool
+}
+
+func NewDryRunExecutor() (this *DryRunExecutor) {
+	this = &DryRunExecutor{
+		created: make(map[string]bool),
+		removed: make(map[string]bool),
+	}
+	return
+}
+
+// a file that would have been written by a DryRunExecutor
+type dryRunFile struct {
+	path string
+}
+
+func (this *dryRunFile) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (this *dryRunFile) Close() error {
+	return nil
+}
+
+func (this *DryRunExecutor) print(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
+func (this *DryRunExecutor) Run(cmd, wd string, argv []string, stdout, stderr io.Writer, timeout time.Duration) (killed bool, err error) {
+	line := ShellQuote(append([]string{cmd}, argv[1:]...))
+	if f, ok := stdout.(*dryRunFile); ok {
+		line += " > " + ShellQuote([]string{GetRelative(wd, f.path, CWD)})
+	}
+	this.print("(in %s) %s", wd, line)
+	// whatever the command names, it may write
+	for _, arg := range argv[1:] {
+		if !filepath.IsAbs(arg) {
+			arg = filepath.Join(wd, arg)
+		}
+		this.create(arg)
+	}
+	return
+}
+
+func (this *DryRunExecutor) MkdirAll(dir string) error {
+	this.create(dir)
+	this.print("mkdir -p %s", ShellQuote([]string{dir}))
+	return nil
+}
+
+func (this *DryRunExecutor) Remove(path string) error {
+	info, err := this.Stat(path)
+	if err != nil && !this.exists(path) {
+		return err
+	}
+	this.remove(path)
+	if info != nil && info.IsDir() {
+		this.print("rmdir %s", ShellQuote([]string{path}))
+	} else {
+		this.print("rm -f %s", ShellQuote([]string{path}))
+	}
+	return nil
+}
+
+func (this *DryRunExecutor) RemoveAll(path string) error {
+	if _, err := this.Stat(path); err != nil && !this.exists(path) {
+		return nil
+	}
+	this.remove(path)
+	this.print("rm -rf %s", ShellQuote([]string{path}))
+	return nil
+}
+
+func (this *DryRunExecutor) Rename(from, to string) error {
+	this.remove(from)
+	this.create(to)
+	this.print("mv -f %s", ShellQuote([]string{from, to}))
+	return nil
+}
+
+func (this *DryRunExecutor) Create(path string, perm os.FileMode) (io.WriteCloser, error) {
+	this.create(path)
+	this.print("write %s", ShellQuote([]string{path}))
+	return &dryRunFile{path: path}, nil
+}
+
+// Stat only knows about what is really there, less what would have been
+// removed.
+func (this *DryRunExecutor) Stat(path string) (info os.FileInfo, err error) {
+	if this.gone(path) {
+		err = &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+		return
+	}
+	return os.Stat(path)
+}
+
+// whether path was, or is inside, something that would have been removed
+func (this *DryRunExecutor) gone(path string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for p := filepath.Clean(path); ; p = filepath.Dir(p) {
+		if this.removed[p] {
+			return true
+		}
+		if p == filepath.Dir(p) {
+			return false
+		}
+	}
+}
+
+// whether path would have been created, and not removed since
+func (this *DryRunExecutor) exists(path string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.created[filepath.Clean(path)]
+}
+
+func (this *DryRunExecutor) create(path string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	path = filepath.Clean(path)
+	this.created[path] = true
+	for p := path; ; p = filepath.Dir(p) {
+		delete(this.removed, p)
+		if p == filepath.Dir(p) {
+			break
+		}
+	}
+}
+
+func (this *DryRunExecutor) remove(path string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	path = filepath.Clean(path)
+	this.removed[path] = true
+	for p := range this.created {
+		if p == path || HasPathPrefix(p, path) {
+			delete(this.created, p)
+		}
+	}
+}
+
+// ShellQuote joins words with spaces, quoting the ones a shell would split
+// or expand.
+func ShellQuote(words []string) string {
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		if word != "" && !strings.ContainsAny(word, " \t\n\"'\\$`*?[]{}()<>|&;#~") {
+			quoted[i] = word
+			continue
+		}
+		quoted[i] = "'" + strings.Replace(word, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// WriteFile writes data to path through Exec.
+func WriteFile(path string, data []byte, perm os.FileMode) (err error) {
+	var fout io.WriteCloser
+	if fout, err = Exec.Create(path, perm); err != nil {
+		return
+	}
+	if _, err = fout.Write(data); err != nil {
+		fout.Close()
+		return
+	}
+	err = fout.Close()
+	return
+}
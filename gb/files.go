@@ -22,6 +22,7 @@ import (
 	"io"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 )
 
@@ -39,51 +40,89 @@ var (
 		"386":   true,
 		"arm":   true,
 	}
+	// names that stand for several values of GOOS
+	os_groups = map[string][]string{
+		"unix":  {"darwin", "freebsd", "openbsd", "linux"},
+		"posix": {"darwin", "freebsd", "openbsd", "linux", "windows"},
+		"bsd":   {"darwin", "freebsd", "openbsd"},
+	}
 )
 
-func CheckCGOFlag(flag string) bool {
-	if flag == GOOS || flag == GOARCH {
-		return true
+// LoadPlatforms extends the known platforms with the workspace's gb.cfg keys
+// goos=, goarch= and group.<name>=, which each take a list of GOOS or GOARCH
+// values.
+func LoadPlatforms(cfg Config) {
+	if list, set := cfg["goos"]; set {
+		for _, name := range SplitTags(list) {
+			os_flags[name] = true
+		}
 	}
-	if flag == "unix" &&
-		(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "linux") {
-		return true
+	if list, set := cfg["goarch"]; set {
+		for _, name := range SplitTags(list) {
+			arch_flags[name] = true
+		}
 	}
-	if flag == "posix" &&
-		(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "linux" || GOOS == "windows") {
-		return true
+	for key, list := range cfg {
+		if !strings.HasPrefix(key, "group.") {
+			continue
+		}
+		group := key[len("group."):]
+		for _, name := range SplitTags(list) {
+			os_groups[group] = append(os_groups[group], name)
+		}
 	}
-	if flag == "bsd" &&
-		(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "openbsd") {
+}
+
+// IsOSName reports whether name is a known GOOS or a group of them.
+func IsOSName(name string) bool {
+	_, isGroup := os_groups[name]
+	return os_flags[name] || isGroup
+}
+
+// MatchOS reports whether name is GOOS or a group that includes it.
+func MatchOS(name string) bool {
+	if name == GOOS {
 		return true
 	}
+	for _, member := range os_groups[name] {
+		if member == GOOS {
+			return true
+		}
+	}
 	return false
 }
 
+func CheckCGOFlag(flag string) bool {
+	return flag == GOARCH || MatchOS(flag)
+}
+
+// FilterFlag applies the file name rules: name_GOOS_GOARCH.ext,
+// name_GOOS.ext and name_GOARCH.ext (optionally followed by _test) are only
+// built for the matching platform. Groups like unix may stand in for GOOS.
 func FilterFlag(src string) bool {
-	for flag := range os_flags {
-		if strings.Contains(src, "_"+flag) && GOOS != flag {
-			return false
-		}
+	name := path.Base(src)
+	if dot := strings.Index(name, "."); dot != -1 {
+		name = name[:dot]
 	}
-	for flag := range arch_flags {
-		if strings.Contains(src, "_"+flag) && GOARCH != flag {
-			return false
-		}
+	// only the part after the first _ can name a platform
+	i := strings.Index(name, "_")
+	if i == -1 {
+		return true
 	}
-	if strings.Contains(src, "_unix") &&
-		!(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "linux") {
-		return false
+	l := strings.Split(name[i:], "_")
+	if n := len(l); n > 0 && l[n-1] == "test" {
+		l = l[:n-1]
 	}
-	if strings.Contains(src, "_posix") &&
-		!(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "linux" || GOOS == "windows") {
-		return false
+	n := len(l)
+	if n >= 2 && IsOSName(l[n-2]) && arch_flags[l[n-1]] {
+		return MatchOS(l[n-2]) && l[n-1] == GOARCH
 	}
-	if strings.Contains(src, "_bsd") &&
-		!(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd") {
-		return false
+	if n >= 1 && IsOSName(l[n-1]) {
+		return MatchOS(l[n-1])
+	}
+	if n >= 1 && arch_flags[l[n-1]] {
+		return l[n-1] == GOARCH
 	}
-
 	return true
 }
 
@@ -104,27 +143,12 @@ func splitPathAll(p string) (bits []string) {
 func FilterPkg(dir string) bool {
 	splitdir := splitPathAll(dir)
 	for _, flag := range splitdir {
-		if os_flags[flag] && flag != GOOS {
+		if IsOSName(flag) && !MatchOS(flag) {
 			return false
 		}
 		if arch_flags[flag] && flag != GOARCH {
 			return false
 		}
-		if flag == "unix" {
-			if !(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "linux") {
-				return false
-			}
-		}
-		if flag == "posix" {
-			if !(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd" || GOOS == "linux" || GOOS == "windows") {
-				return false
-			}
-		}
-		if flag == "bsd" {
-			if !(GOOS == "darwin" || GOOS == "freebsd" || GOOS == "bsd") {
-				return false
-			}
-		}
 	}
 	return true
 }
@@ -139,7 +163,7 @@ func GetSubDirs(dir string) (subdirs []string) {
 		return
 	}
 	for _, info := range infos {
-		if info.IsDir() {
+		if info.IsDir() && !IgnoredDir(filepath.Join(dir, info.Name())) {
 			subdirs = append(subdirs, info.Name())
 		}
 	}
@@ -154,8 +178,10 @@ func PkgExistsInGOROOT(target string) (exists bool, time int64) {
 		target = target[0 : len(target)-1]
 	}
 
-	pkgbin := path.Join(GetGOROOTDirPkg(), target)
-	pkgbin += ".a"
+	pkgbin, found := Tools.GOROOTArchive(target)
+	if !found {
+		return
+	}
 
 	time, err := StatTime(pkgbin)
 
@@ -215,7 +241,7 @@ func ReverseDirForwardSlash(dir string) (rev string) {
 
 func StatTime(p string) (time int64, err error) {
 	var info os.FileInfo
-	info, err = os.Stat(p)
+	info, err = Exec.Stat(p)
 	if err != nil {
 		return
 	}
@@ -241,8 +267,8 @@ func CopyTheHardWay(cwd, src, dst string) (err error) {
 		return
 	}
 
-	var dstFile *os.File
-	dstFile, err = os.Create(dstpath)
+	var dstFile io.WriteCloser
+	dstFile, err = Exec.Create(dstpath, 0644)
 	if err != nil {
 		return
 	}
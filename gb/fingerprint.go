@@ -0,0 +1,312 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fingerprints live in the workspace's package build directory, one file per
+// target, so that cleaning the workspace also forgets them
+const FingerprintDir = ".gbhash"
+
+// A Fingerprint records everything that went into building a target. Keys are
+// qualified by kind ("src:foo.go", "dep:x/y", "flags:gcflags", "tool:compile") and
+// map to a content hash or a literal flag string.
+type Fingerprint map[string]string
+
+type fileSum struct {
+	size, mtime int64
+	sum         string
+}
+
+var fileSums = make(map[string]fileSum)
+var fileSumsLock sync.Mutex
+
+// FileSum returns the sha1 of a file's contents. Results are remembered for as
+// long as the file's size and modification time stay the same.
+func FileSum(p string) (sum string, err error) {
+	var info os.FileInfo
+	info, err = os.Stat(p)
+	if err != nil {
+		return
+	}
+	size, mtime := info.Size(), info.ModTime().UnixNano()
+
+	fileSumsLock.Lock()
+	fs, ok := fileSums[p]
+	fileSumsLock.Unlock()
+	if ok && fs.size == size && fs.mtime == mtime {
+		sum = fs.sum
+		return
+	}
+
+	var fin *os.File
+	fin, err = os.Open(p)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	h := sha1.New()
+	if _, err = io.Copy(h, fin); err != nil {
+		return
+	}
+	sum = fmt.Sprintf("%x", h.Sum(nil))
+
+	fileSumsLock.Lock()
+	fileSums[p] = fileSum{size, mtime, sum}
+	fileSumsLock.Unlock()
+	return
+}
+
+// ToolVersion identifies an external tool by its location, size and
+// modification time, which change whenever the toolchain is rebuilt.
+func ToolVersion(cmd string) (version string) {
+	if cmd == "" {
+		return
+	}
+	info, err := os.Stat(cmd)
+	if err != nil {
+		return cmd
+	}
+	return fmt.Sprintf("%s %d %d", cmd, info.Size(), info.ModTime().UnixNano())
+}
+
+// ExternalArchive finds the installed archive for an import that is not a
+// target in this workspace, from the standard library or a GOPATH.
+func ExternalArchive(dep string) (archive string, found bool) {
+	target := strings.Trim(dep, "\"")
+	if archive, found = Tools.GOROOTArchive(target); found {
+		return
+	}
+	for _, dir := range GOPATH_OBJDSTS {
+		archive = filepath.Join(dir, Tools.ArchiveName(target))
+		if _, err := os.Stat(archive); err == nil {
+			found = true
+			return
+		}
+	}
+	return
+}
+
+func ReadFingerprint(p string) (fp Fingerprint, err error) {
+	var fin *os.File
+	fin, err = os.Open(p)
+	if err != nil {
+		return
+	}
+	defer fin.Close()
+
+	fp = make(Fingerprint)
+	br := bufio.NewReader(fin)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		line = strings.TrimRight(line, "\n")
+		split := strings.Index(line, "\t")
+		if split == -1 {
+			err = errors.New(fmt.Sprintf("fingerprint malformed: %s", p))
+			return
+		}
+		fp[line[:split]] = line[split+1:]
+	}
+	return
+}
+
+func (fp Fingerprint) Write(p string) (err error) {
+	if err = Exec.MkdirAll(filepath.Dir(p)); err != nil {
+		return
+	}
+	var fout io.WriteCloser
+	fout, err = Exec.Create(p, 0644)
+	if err != nil {
+		return
+	}
+
+	var keys []string
+	for key := range fp {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(fout, "%s\t%s\n", key, fp[key])
+	}
+
+	err = fout.Close()
+	return
+}
+
+func (fp Fingerprint) Equal(other Fingerprint) bool {
+	if len(fp) != len(other) {
+		return false
+	}
+	for key, val := range fp {
+		if oval, ok := other[key]; !ok || oval != val {
+			return false
+		}
+	}
+	return true
+}
+
+func (this *Package) FingerprintPath() string {
+	key := GetAbs(this.Dir, CWD)
+	if this.IsCmd {
+		key += "-cmd"
+	}
+	h := sha1.New()
+	h.Write([]byte(key))
+	name := fmt.Sprintf("%x", h.Sum(nil))
+	return filepath.Join(GetBuildDirPkg(), FingerprintDir, name)
+}
+
+// ArchiveSources lists the files that go into the target's archive or binary,
+// leaving out the tests and the files of other packages in its directory.
+func (this *Package) ArchiveSources() (files []string) {
+	files = append(files, this.PkgSrc[this.Name]...)
+	files = append(files, this.CGoSources...)
+	files = append(files, this.AsmSrcs...)
+	files = append(files, this.CSrcs...)
+	files = append(files, this.CHeaders...)
+	return
+}
+
+// ComputeFingerprint collects the current inputs of the target: the contents
+// of its source files, the effective compiler and linker flags, the archives
+// of its dependencies and the tools that will build it.
+func (this *Package) ComputeFingerprint() (fp Fingerprint) {
+	fp = make(Fingerprint)
+
+	fp["target"] = this.Target
+	fp["env:GOOS"] = GOOS
+	fp["env:GOARCH"] = GOARCH
+
+	for _, src := range this.ArchiveSources() {
+		sum, err := FileSum(filepath.Join(this.Dir, src))
+		if err != nil {
+			sum = "missing"
+		}
+		fp["src:"+src] = sum
+	}
+
+	gcflags, _ := this.Cfg.GCFlags()
+	fp["flags:gcflags"] = gcflags
+	fp["flags:GCFLAGS"] = strings.Join(GCFLAGS, " ")
+	fp["flags:GLDFLAGS"] = strings.Join(GLDFLAGS, " ")
+	if this.IsCGo {
+		cflags := append([]string{}, this.CGoCFlags[this.Name]...)
+		sort.Strings(cflags)
+		ldflags := append([]string{}, this.CGoLDFlags[this.Name]...)
+		sort.Strings(ldflags)
+		fp["flags:cgo-cflags"] = strings.Join(cflags, " ")
+		fp["flags:cgo-ldflags"] = strings.Join(ldflags, " ")
+		fp["flags:cgo-pkg-config"] = strings.Join(this.CGoPkgConfig[this.Name], " ")
+	}
+
+	for _, pkg := range this.DepPkgs {
+		sum, err := FileSum(pkg.ResultPath)
+		if err != nil {
+			sum = "missing"
+		}
+		fp["dep:"+pkg.Target] = sum
+	}
+	for _, dep := range this.Deps {
+		if _, ok := Packages[dep]; ok || dep == "\"C\"" {
+			continue
+		}
+		if archive, found := ExternalArchive(dep); found {
+			if sum, err := FileSum(archive); err == nil {
+				fp["dep:"+strings.Trim(dep, "\"")] = sum
+			}
+		}
+	}
+
+	tools := map[string]string{
+		"compile": CompileCMD,
+		"pack":    PackCMD,
+	}
+	if this.IsCmd {
+		tools["link"] = LinkCMD
+	}
+	if len(this.AsmSrcs) != 0 {
+		tools["asm"] = AsmCMD
+	}
+	if this.IsCGo {
+		tools["cgo"] = CGoCMD
+		tools["gcc"] = GCCCMD
+		tools["cc"] = CCMD
+	}
+	if this.IsProtobuf {
+		tools["protoc"] = ProtocCMD
+	}
+	fp["toolchain"] = Tools.Name()
+	for name, cmd := range tools {
+		fp["tool:"+name] = ToolVersion(cmd)
+	}
+
+	return
+}
+
+// Fingerprint returns the fingerprint of the target's current inputs,
+// computing it at most once until it is invalidated by a build.
+func (this *Package) Fingerprint() Fingerprint {
+	if this.fingerprint == nil {
+		this.fingerprint = this.ComputeFingerprint()
+	}
+	return this.fingerprint
+}
+
+// Stale reports whether the target's inputs differ from the ones recorded at
+// its last build. Targets gb has never fingerprinted fall back to comparing
+// inTime, the newest of the input times, with the result's modification time.
+func (this *Package) Stale(inTime int64) bool {
+	if this.BinTime == 0 {
+		return true
+	}
+	stored, err := ReadFingerprint(this.FingerprintPath())
+	if err != nil {
+		return inTime > this.BinTime
+	}
+	return !stored.Equal(this.Fingerprint())
+}
+
+func (this *Package) SaveFingerprint() (err error) {
+	this.fingerprint = nil
+	err = this.Fingerprint().Write(this.FingerprintPath())
+	return
+}
+
+func (this *Package) RemoveFingerprint() (err error) {
+	this.fingerprint = nil
+	err = Exec.Remove(this.FingerprintPath())
+	return
+}
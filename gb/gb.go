@@ -20,10 +20,15 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // command line flags
@@ -33,7 +38,11 @@ var Install, //-i
 	Scan, //-sS
 	ScanList, //-S
 	ScanListFiles, //-L
+	ScanJSON, //--json
+	Graph, //--graph
+	ShowConfig, //--config
 	Test, //-t
+	Cover, //--cover
 	Exclusive, //-e
 	BuildGOROOT, //-R
 	GoInstall, //-gG
@@ -50,12 +59,19 @@ var Install, //-i
 	DoCmds, //-C
 	Distribution, //--dist (deprecated)
 	Workspace, //--workspace
+	Watch, //--watch
+	DryRun, //-n
 	MakeAMess bool //--make-a-mess
 
 var IncludeDir string
+var Jobs = runtime.NumCPU() //-j
+var GraphDepth int //--graph-depth
+var TestTimeout time.Duration //--test-timeout
+var CoverHTML string //--cover-html
 var GCArgs []string
 var GLArgs []string
 var PackagesBuilt int
+var BuiltTargets []string
 var PackagesCleaned int
 var PackagesInstalled int
 var BrokenPackages int
@@ -142,10 +158,10 @@ var OSFiltersMust = map[string]string{
 }
 
 func ScanDirectory(base, dir string, inTestData string, parent *Package) (err2 error) {
-	_, basedir := filepath.Split(dir)
-	if DisallowedSourceDirectories[basedir] || (basedir != "." && strings.HasPrefix(basedir, ".")) {
+	if IgnoredDir(dir) {
 		return
 	}
+	_, basedir := filepath.Split(dir)
 
 	if basedir == "testdata" {
 		// if gb isn't actually run from within here, ignore it all
@@ -158,16 +174,17 @@ func ScanDirectory(base, dir string, inTestData string, parent *Package) (err2 e
 		base = "."
 	}
 
-	cfg := ReadConfig(dir)
+	cfg, sources := EffectiveConfig(dir)
 
 	if Workspace {
 		absdir := GetAbs(dir, CWD)
 		relworkspace := GetRelative(absdir, CWD, CWD)
 
-		cfg["workspace"] = relworkspace
-		if err := cfg.Write(absdir); err != nil {
+		// only the workspace= line of its gb.cfg changes
+		if err := SetConfig(absdir, "workspace", relworkspace); err != nil {
 			ErrLog.Println(err)
 		}
+		cfg["workspace"] = relworkspace
 	}
 
 	if ignoreAll, ok := cfg.IgnoreAll(); ignoreAll && ok {
@@ -181,10 +198,8 @@ func ScanDirectory(base, dir string, inTestData string, parent *Package) (err2 e
 	if ignore, ok := cfg.Ignore(); !(ignore && ok) {
 		pkg, err = NewPackage(base, dir, inTestData, parent, cfg)
 		if err == nil {
-			key := "\"" + pkg.Target + "\""
-			if pkg.IsCmd {
-				key += "-cmd"
-			}
+			pkg.CfgSources = sources
+			key := pkg.packagesKey()
 			if dup, exists := Packages[key]; exists {
 				if GetAbs(dup.Dir, CWD) != GetAbs(pkg.Dir, CWD) {
 					ErrLog.Printf("Duplicate target: %s\n in %s\n in %s\n", pkg.Target, dup.Dir, pkg.Dir)
@@ -198,7 +213,7 @@ func ScanDirectory(base, dir string, inTestData string, parent *Package) (err2 e
 				base = tbase
 			}
 		}
-	} else {
+	} else if !ScanJSON {
 		fmt.Println(dir, "ignored")
 	}
 
@@ -256,6 +271,21 @@ func TryScan() {
 	}
 }
 
+func TryConfig() {
+	if ShowConfig {
+		for _, pkg := range ListedPkgs {
+			pkg.PrintConfig()
+		}
+	}
+}
+
+func TryGraph() (err error) {
+	if Graph {
+		err = WriteGraph(os.Stdout, ListedPkgs, GraphDepth)
+	}
+	return
+}
+
 func TryGoFMT() (err error) {
 	if GoFMT {
 		for _, pkg := range ListedPkgs {
@@ -293,13 +323,13 @@ func TryGenMake() (err error) {
 				fmt.Scanf("%s", &answer)
 				genBuild = answer == "y" || answer == "Y"
 			}
-			os.Remove("build")
+			Exec.Remove("build")
 		}
 
 		if genBuild {
 			fmt.Printf("(in .) generating build script\n")
-			var buildFile *os.File
-			buildFile, err = os.OpenFile("build", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+			var buildFile io.WriteCloser
+			buildFile, err = Exec.Create("build", 0755)
 			bwrite := func(format string, args ...interface{}) {
 				if err != nil {
 					return
@@ -365,9 +395,12 @@ func TryDistribution() (err error) {
 func TryClean() {
 	if Clean && ListedTargets == 0 {
 		fmt.Println("Removing " + GetBuildDirPkg())
-		os.RemoveAll(GetBuildDirPkg())
+		Exec.RemoveAll(GetBuildDirPkg())
 		fmt.Println("Removing " + GetBuildDirCmd())
-		os.RemoveAll(GetBuildDirCmd())
+		Exec.RemoveAll(GetBuildDirCmd())
+		// only goes away once no other platform's results are left
+		Exec.Remove(ObjDir)
+		Exec.Remove(BinDir)
 		PackagesCleaned++
 	}
 	if Clean && len(ListedDirs) == 1 {
@@ -377,12 +410,14 @@ func TryClean() {
 		}
 		base := filepath.Base(dir)
 		if base == "testdata" {
-			testObj := filepath.Join(dir, "_obj")
-			testBin := filepath.Join(dir, "_bin")
+			testObj := filepath.Join(dir, GetBuildDirPkg())
+			testBin := filepath.Join(dir, GetBuildDirCmd())
 			fmt.Println("Removing " + testObj)
-			os.RemoveAll(testObj)
+			Exec.RemoveAll(testObj)
 			fmt.Println("Removing " + testBin)
-			os.RemoveAll(testBin)
+			Exec.RemoveAll(testBin)
+			Exec.Remove(filepath.Join(dir, ObjDir))
+			Exec.Remove(filepath.Join(dir, BinDir))
 			PackagesCleaned++
 		}
 	}
@@ -394,16 +429,17 @@ func TryClean() {
 	}
 }
 
-func TryBuild() {
+func TryBuild(pkgs []*Package) {
 
 	if Build {
 		if Concurrent {
-			for _, pkg := range ListedPkgs {
+			for _, pkg := range pkgs {
 				pkg.CheckStatus()
-				go pkg.Build()
 			}
+			BuildConcurrently(pkgs, Jobs)
+			return
 		}
-		for _, pkg := range ListedPkgs {
+		for _, pkg := range pkgs {
 			pkg.CheckStatus()
 			err := pkg.Build()
 			if err != nil {
@@ -413,15 +449,31 @@ func TryBuild() {
 	}
 }
 
-func TryTest() (err error) {
+func TryTest(pkgs []*Package) (err error) {
 	if Test {
-		for _, pkg := range ListedPkgs {
-			if len(pkg.TestSources) != 0 {
-				err = pkg.Test()
-				if err != nil {
-					return
+		if Concurrent {
+			var testPkgs []*Package
+			for _, pkg := range pkgs {
+				if len(pkg.TestSources) != 0 {
+					testPkgs = append(testPkgs, pkg)
 				}
 			}
+			err = TestConcurrently(testPkgs, Jobs)
+		} else {
+			for _, pkg := range pkgs {
+				if len(pkg.TestSources) != 0 {
+					err = pkg.Test()
+					if err != nil {
+						break
+					}
+				}
+			}
+		}
+		if rerr := WriteTestReport(); err == nil {
+			err = rerr
+		}
+		if cerr := WriteCoverage(); err == nil {
+			err = cerr
 		}
 	}
 	return
@@ -445,11 +497,9 @@ func TryInstall() {
 	}
 }
 
-func RunGB() (err error) {
-	Build = Build || (!Clean && !Scan) || (Makefiles && !Clean) || Install || Test
-
-	Build = Build && HardArgs == 0
-
+// ScanWorkspace finds the targets in the workspace, and in GOROOT and GOPATH
+// with -R, picks the listed ones and resolves their dependencies.
+func ScanWorkspace() (err error) {
 	DoPkgs, DoCmds = DoPkgs || (!DoPkgs && !DoCmds), DoCmds || (!DoPkgs && !DoCmds)
 
 	ListedDirs = make(map[string]bool)
@@ -461,13 +511,14 @@ func RunGB() (err error) {
 		return
 	}
 	if BuildGOROOT {
-		fmt.Printf("Scanning %s...", filepath.Join("GOROOT", "src"))
+		// progress goes to stderr, to keep it out of --json and --graph
+		fmt.Fprintf(os.Stderr, "Scanning %s...", filepath.Join("GOROOT", "src"))
 		ScanDirectory("", filepath.Join(GOROOT, "src"), "", nil)
-		fmt.Printf("done\n")
+		fmt.Fprintf(os.Stderr, "done\n")
 		for _, gp := range GOPATHS {
-			fmt.Printf("Scanning %s...", filepath.Join(gp, "src"))
+			fmt.Fprintf(os.Stderr, "Scanning %s...", filepath.Join(gp, "src"))
 			ScanDirectory("", filepath.Join(gp, "src"), "", nil)
-			fmt.Printf("done\n")
+			fmt.Fprintf(os.Stderr, "done\n")
 		}
 	}
 
@@ -502,6 +553,8 @@ func RunGB() (err error) {
 		}
 	}
 
+	sort.Sort(byTarget(ListedPkgs))
+
 	for lt := range ListedDirs {
 		if !ValidatedDirs[lt] {
 			err = errors.New(fmt.Sprintf("Listed directory %q doesn't correspond to a known package", lt))
@@ -537,9 +590,31 @@ func RunGB() (err error) {
 	for _, pkg := range Packages {
 		pkg.CheckStatus()
 	}
+	return
+}
+
+func RunGB() (err error) {
+	Build = Build || (!Clean && !Scan) || (Makefiles && !Clean) || Install || Test
+
+	Build = Build && HardArgs == 0 && WhyTarget == ""
+
+	if err = ScanWorkspace(); err != nil {
+		return
+	}
+
+	if WhyTarget != "" {
+		err = TryWhy()
+		return
+	}
 
 	TryScan()
 
+	TryConfig()
+
+	if err = TryGraph(); err != nil {
+		return
+	}
+
 	if err = TryGoFix(); err != nil {
 		return
 	}
@@ -558,9 +633,9 @@ func RunGB() (err error) {
 
 	TryClean()
 
-	TryBuild()
+	TryBuild(ListedPkgs)
 
-	if err = TryTest(); err != nil {
+	if err = TryTest(ListedPkgs); err != nil {
 		return
 	}
 
@@ -601,7 +676,13 @@ func RunGB() (err error) {
 }
 
 func CheckFlags() bool {
+	// arguments consumed as the value of a flag, by index in os.Args
+	flagValues := make(map[int]bool)
+
 	for i, arg := range os.Args[1:] {
+		if flagValues[i+1] {
+			continue
+		}
 		if arg == "--testargs" {
 			TestArgs = append(TestArgs, os.Args[i+2:]...)
 			os.Args = os.Args[:i+2]
@@ -616,7 +697,12 @@ func CheckFlags() bool {
 			continue
 		}
 		if strings.HasPrefix(arg, "--") {
-			switch arg {
+			// --name=value
+			name, value := arg, ""
+			if eq := strings.Index(arg, "="); eq != -1 {
+				name, value = arg[:eq], arg[eq+1:]
+			}
+			switch name {
 			case "--gofmt":
 				GoFMT = true
 				HardArgs++
@@ -633,12 +719,134 @@ func CheckFlags() bool {
 				HardArgs++
 			case "--make-a-mess":
 				MakeAMess = true
+			case "--json":
+				ScanJSON = true
+			case "--graph":
+				Graph = true
+				HardArgs++
+			case "--config":
+				ShowConfig = true
+				HardArgs++
+			case "--why":
+				// --why=<dir-or-target> or --why <dir-or-target>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				if value == "" {
+					ErrLog.Printf("--why needs a directory or target\n")
+					return false
+				}
+				WhyTarget = value
+			case "--tags":
+				// --tags=<list> or --tags <list>
+				if !strings.Contains(arg, "=") {
+					if i+2 >= len(os.Args) {
+						ErrLog.Printf("--tags needs a list of build tags\n")
+						return false
+					}
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				BuildTags = append(BuildTags, SplitTags(value)...)
+			case "--platforms":
+				// --platforms=<list> or --platforms <list>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				var err error
+				if Platforms, err = ParsePlatforms(value); err != nil {
+					ErrLog.Printf("%v\n", err)
+					return false
+				}
+			case "--test-report":
+				// --test-report=<format>:<path> or --test-report <format>:<path>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				var err error
+				if TestReportFormat, TestReportPath, err = ParseTestReport(value); err != nil {
+					ErrLog.Printf("%v\n", err)
+					return false
+				}
+				// the path is relative to where gb was run, not the workspace
+				TestReportPath = GetAbs(TestReportPath, OSWD)
+			case "--watch":
+				// --watch or --watch=<interval>
+				Watch = true
+				if value != "" {
+					var err error
+					if WatchInterval, err = time.ParseDuration(value); err != nil || WatchInterval <= 0 {
+						ErrLog.Printf("--watch needs an interval like 500ms or 2s\n")
+						return false
+					}
+				}
+			case "--serve":
+				// --serve=<socket> or --serve <socket>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				if value == "" {
+					ErrLog.Printf("--serve needs the path of a socket\n")
+					return false
+				}
+				// the path is relative to where gb was run, not the workspace
+				ServeSocket = GetAbs(value, OSWD)
+			case "--cover":
+				Cover = true
+			case "--cover-html":
+				// --cover-html=<path> or --cover-html <path>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				if value == "" {
+					ErrLog.Printf("--cover-html needs a path\n")
+					return false
+				}
+				Cover = true
+				// the path is relative to where gb was run, not the workspace
+				CoverHTML = GetAbs(value, OSWD)
+			case "--test-timeout":
+				// --test-timeout=<duration> or --test-timeout <duration>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				var err error
+				if TestTimeout, err = time.ParseDuration(value); err != nil || TestTimeout <= 0 {
+					ErrLog.Printf("--test-timeout needs a duration like 30s or 5m\n")
+					return false
+				}
+			case "--toolchain":
+				// --toolchain=<name> or --toolchain <name>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				ToolchainName = value
+			case "--graph-depth":
+				// --graph-depth=<n> or --graph-depth <n>
+				if !strings.Contains(arg, "=") && i+2 < len(os.Args) {
+					value = os.Args[i+2]
+					flagValues[i+2] = true
+				}
+				n, err := strconv.Atoi(value)
+				if err != nil || n < 0 {
+					ErrLog.Printf("--graph-depth needs a number of imports\n")
+					return false
+				}
+				GraphDepth = n
 			default:
 				Usage()
 				return false
 			}
 		} else if strings.HasPrefix(arg, "-") {
-			for _, flag := range arg[1:] {
+		flags:
+			for j, flag := range arg[1:] {
 				switch flag {
 				case 'i':
 					Install = true
@@ -676,6 +884,21 @@ func CheckFlags() bool {
 					BuildArgs++
 				case 'p':
 					Concurrent = true
+				case 'j':
+					// -j <n> or -j<n>
+					value := arg[j+2:]
+					if value == "" && i+2 < len(os.Args) {
+						value = os.Args[i+2]
+						flagValues[i+2] = true
+					}
+					n, err := strconv.Atoi(value)
+					if err != nil || n < 1 {
+						ErrLog.Printf("-j needs a positive number of jobs")
+						return false
+					}
+					Jobs = n
+					Concurrent = true
+					break flags
 				case 'P':
 					DoPkgs = true
 				case 'C':
@@ -685,6 +908,8 @@ func CheckFlags() bool {
 				case 'N':
 					Clean = true
 					Nuke = true
+				case 'n':
+					DryRun = true
 				default:
 					Usage()
 					return false
@@ -693,6 +918,61 @@ func CheckFlags() bool {
 		}
 	}
 
+	if len(flagValues) != 0 {
+		var args []string
+		for i, arg := range os.Args {
+			if !flagValues[i] {
+				args = append(args, arg)
+			}
+		}
+		os.Args = args
+	}
+
+	if TestReportFormat != "" && !Test {
+		ErrLog.Printf("--test-report must be used with -t\n")
+		return false
+	}
+	if Cover && !Test {
+		ErrLog.Printf("--cover must be used with -t\n")
+		return false
+	}
+	if TestTimeout != 0 && !Test {
+		ErrLog.Printf("--test-timeout must be used with -t\n")
+		return false
+	}
+
+	if Watch && (HardArgs > 0 || Clean || Scan || Install || len(Platforms) != 0) {
+		ErrLog.Printf("--watch only builds and tests; it cannot be used with -- style commands, -c, -N, -s, -i or --platforms\n")
+		return false
+	}
+
+	if ServeSocket != "" && (HardArgs > 0 || BuildArgs > 0 || Clean || Scan || Watch || len(Platforms) != 0) {
+		ErrLog.Printf("--serve cannot be used with other commands\n")
+		return false
+	}
+
+	// -g and -G change what is out of date, so they may go with --why
+	if WhyTarget != "" && (HardArgs > 0 || Clean || Scan || Install || Build || Test || Watch || ServeSocket != "" || len(Platforms) != 0) {
+		ErrLog.Printf("--why cannot be used with -- style commands, -c, -N, -s, -b, -i, -t, --watch, --serve or --platforms\n")
+		return false
+	}
+
+	if DryRun && (Watch || ServeSocket != "") {
+		ErrLog.Printf("-n cannot be used with --watch or --serve\n")
+		return false
+	}
+	if DryRun {
+		// one target at a time, so that the commands come out in the order
+		// they would run
+		Concurrent = false
+		Exec = NewDryRunExecutor()
+	}
+
+	if ScanJSON && !Scan {
+		ErrLog.Printf("--json must be used with -s, -S or -L\n")
+		return false
+	}
+
 	if HardArgs > 0 && BuildArgs > 0 {
 		ErrLog.Printf("Cannot have -- style arguments and build at the same time.\n")
 		return false
@@ -715,28 +995,53 @@ func main() {
 		return
 	}
 
-	err := FindExternals()
-	if err != nil {
+	if err := SelectToolchain(); err != nil {
+		ErrLog.Printf("%v\n", err)
 		return
 	}
 
-	GCArgs = []string{}
-	GLArgs = []string{}
+	if len(Platforms) != 0 {
+		if RunPlatforms() {
+			ReturnFailCode = true
+		}
+	} else {
+		err := FindExternals()
+		if err != nil {
+			return
+		}
+		MakeObjDirs()
 
-	if !Install {
-		IncludeDir = GetBuildDirPkg()
-		GCArgs = append(GCArgs, []string{"-I", IncludeDir}...)
-		GLArgs = append(GLArgs, []string{"-L", IncludeDir}...)
-	}
+		GCArgs = []string{}
+		GLArgs = []string{}
 
-	err = RunGB()
-	if err != nil {
-		ErrLog.Printf("%v\n", err)
-		ReturnFailCode = true
-	}
+		if !Install {
+			IncludeDir = GetBuildDirPkg()
+			GCArgs = append(GCArgs, []string{"-I", IncludeDir}...)
+			GLArgs = append(GLArgs, []string{"-L", IncludeDir}...)
+		}
 
-	if len(BrokenMsg) > 0 {
-		ReturnFailCode = true
+		if ServeSocket != "" {
+			// the server builds and tests on request, so it scans like -t
+			Build, Test = true, true
+			if err = Serve(ServeSocket); err != nil {
+				ErrLog.Printf("%v\n", err)
+				ReturnFailCode = true
+			}
+		} else {
+			err = RunGB()
+			if err != nil {
+				ErrLog.Printf("%v\n", err)
+				ReturnFailCode = true
+			}
+
+			if Watch {
+				WatchWorkspace()
+			}
+
+			if len(BrokenMsg) > 0 {
+				ReturnFailCode = true
+			}
+		}
 	}
 
 	if ReturnFailCode {
@@ -17,8 +17,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 type GATest struct {
@@ -96,6 +109,547 @@ func TestGetRelative(t *testing.T) {
 	TestWindows = false
 }
 
+type SBTest struct {
+	src   string
+	truth bool
+}
+
+func TestShouldBuild(t *testing.T) {
+	sbTests := []SBTest{
+		{"package foo\n", true},
+		{"// +build linux\n\npackage foo\n", true},
+		{"// +build darwin\n\npackage foo\n", false},
+		{"// +build darwin linux\n\npackage foo\n", true},
+		{"// +build linux,386\n\npackage foo\n", false},
+		{"// +build linux,!386\n\npackage foo\n", true},
+		{"// +build !linux\n\npackage foo\n", false},
+		{"// +build linux\n// +build 386\n\npackage foo\n", false},
+		{"// +build unix\n\npackage foo\n", true},
+		{"// +build mytag\n\npackage foo\n", true},
+		{"// +build !mytag\n\npackage foo\n", false},
+		{"// +build !!linux\n\npackage foo\n", false},
+		// not followed by a blank line, so not a constraint
+		{"// +build darwin\npackage foo\n", true},
+		// after the package clause
+		{"package foo\n\n// +build darwin\n", true},
+	}
+
+	GOOS, GOARCH = "linux", "amd64"
+	for _, sbt := range sbTests {
+		result := ShouldBuild([]byte(sbt.src), []string{"mytag"})
+		if result != sbt.truth {
+			t.Error(fmt.Sprintf("ShouldBuild(%q) -> %v, was expecting %v", sbt.src, result, sbt.truth))
+		}
+	}
+	GOOS, GOARCH = "", ""
+}
+
+type FFTest struct {
+	src   string
+	truth bool
+}
+
+func TestFilterFlag(t *testing.T) {
+	ffTests := []FFTest{
+		{"foo.go", true},
+		{"foo_linux.go", true},
+		{"foo_darwin.go", false},
+		{"foo_amd64.go", true},
+		{"foo_arm.go", false},
+		{"foo_linux_amd64.go", true},
+		{"foo_linux_386.go", false},
+		{"foo_darwin_amd64.go", false},
+		{"foo_linux_test.go", true},
+		{"foo_windows_test.go", false},
+		{"foo_unix.go", true},
+		{"foo_bsd.go", false},
+		{"foo_unix_arm.go", false},
+		{"dir/foo_darwin.c", false},
+		{"my_linuxutil.go", true},
+		{"parse_armor.go", true},
+		{"windows_helper.go", true},
+		{"darwin.go", true},
+		{"foo_darwin.pb.go", false},
+	}
+
+	GOOS, GOARCH = "linux", "amd64"
+	for _, fft := range ffTests {
+		result := FilterFlag(fft.src)
+		if result != fft.truth {
+			t.Error(fmt.Sprintf("FilterFlag(%q) -> %v, was expecting %v", fft.src, result, fft.truth))
+		}
+	}
+	GOOS, GOARCH = "", ""
+}
+
+type EOTest struct {
+	body      string
+	output    string
+	unordered bool
+	ok        bool
+}
+
+func TestExampleOutput(t *testing.T) {
+	eoTests := []EOTest{
+		{"fmt.Println(1)\n// Output: 1", "1\n", false, true},
+		{"fmt.Println(1)\n// Output:\n// 1\n// 2", "1\n2\n", false, true},
+		{"fmt.Println(1)\n// unordered output:\n// 2\n// 1", "2\n1\n", true, true},
+		{"fmt.Println(1)\n// Output:", "", false, true},
+		{"// Output: 1\nfmt.Println(1)\n// done", "", false, false},
+		{"fmt.Println(1)", "", false, false},
+	}
+
+	for _, eot := range eoTests {
+		src := "package p\n\nfunc ExampleX() {\n" + eot.body + "\n}\n"
+		file, err := parser.ParseFile(token.NewFileSet(), "x_test.go", src, parser.ParseComments)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		fdecl := file.Decls[0].(*ast.FuncDecl)
+		output, unordered, ok := ExampleOutput(fdecl, file.Comments)
+		if output != eot.output || unordered != eot.unordered || ok != eot.ok {
+			t.Error(fmt.Sprintf("ExampleOutput(%q) -> %q, %v, %v, was expecting %q, %v, %v", eot.body, output, unordered, ok, eot.output, eot.unordered, eot.ok))
+		}
+	}
+}
+
+type PTOTest struct {
+	output string
+	failed bool
+	cases  []TestCaseReport
+}
+
+func TestParseTestOutput(t *testing.T) {
+	ptoTests := []PTOTest{
+		// older testing packages print logs after the result
+		{"--- FAIL: p.TestA (0.50 seconds)\n\tp_test.go:5: bad\nFAIL\n", true, []TestCaseReport{
+			{"p.TestA", "FAIL", 0.5, "p_test.go:5: bad"},
+		}},
+		// current ones print them before, and nest subtests
+		{"=== RUN   p.TestA\n=== RUN   p.TestA/x\n    p_test.go:5: bad\n--- FAIL: p.TestA (0.01s)\n    --- FAIL: p.TestA/x (0.01s)\n=== RUN   p.TestB\n    p_test.go:9: later\n--- SKIP: p.TestB (0.00s)\nFAIL\n", true, []TestCaseReport{
+			{"p.TestA", "FAIL", 0.01, ""},
+			{"p.TestA/x", "FAIL", 0.01, "p_test.go:5: bad"},
+			{"p.TestB", "SKIP", 0, "p_test.go:9: later"},
+		}},
+		// a binary that dies fails the test it was running
+		{"=== RUN   p.TestA\n--- PASS: p.TestA (0.00s)\n=== RUN   p.TestB\nhung\n", true, []TestCaseReport{
+			{"p.TestA", "PASS", 0, ""},
+			{"p.TestB", "FAIL", 0, "hung"},
+		}},
+	}
+
+	for _, ptot := range ptoTests {
+		var runErr error
+		if ptot.failed {
+			runErr = errors.New("exit status 1")
+		}
+		report := ParseTestOutput("p", ptot.output, 0, runErr)
+		if fmt.Sprint(report.Cases) != fmt.Sprint(ptot.cases) {
+			t.Error(fmt.Sprintf("ParseTestOutput(%q) -> %v, was expecting %v", ptot.output, report.Cases, ptot.cases))
+		}
+	}
+}
+
 func BenchmarkX(b *testing.B) {
 	//do nothing
 }
+
+type IFTest struct {
+	body   string
+	stmts  []int
+	counts string
+}
+
+func TestInstrumentFile(t *testing.T) {
+	ifTests := []IFTest{
+		{"a()\nb()", []int{2}, "C.Count[0] = 1; a()\nb()"},
+		{"a()\nif x {\nb()\n}\nc()", []int{2, 1, 1}, "C.Count[0] = 1; a()\nif x {\nC.Count[1] = 1; b()\n}\nC.Count[2] = 1; c()"},
+		{"switch x {\ncase 1:\na()\ndefault:\n}", []int{1, 1}, "C.Count[0] = 1; switch x {\ncase 1:\nC.Count[1] = 1; a()\ndefault:\n}"},
+		{"a()\nL:\nfor {\nbreak L\n}", []int{1, 1, 1}, "C.Count[0] = 1; a()\nC.Count[1] = 1; L:\nfor {\nC.Count[2] = 1; break L\n}"},
+	}
+
+	for _, ift := range ifTests {
+		src := "package p\n\nfunc f() {\n" + ift.body + "\n}\n"
+		out, blocks, err := InstrumentFile("x.go", []byte(src), "C")
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var stmts []int
+		for _, block := range blocks {
+			stmts = append(stmts, block.Stmts)
+		}
+		expected := "package p\n\nfunc f() {\n" + ift.counts + "\n}\n"
+		if !strings.HasPrefix(string(out), expected) || fmt.Sprint(stmts) != fmt.Sprint(ift.stmts) {
+			t.Error(fmt.Sprintf("InstrumentFile(%q) -> %q, %v, was expecting %q, %v", ift.body, out, stmts, expected, ift.stmts))
+		}
+		if _, err := parser.ParseFile(token.NewFileSet(), "x.go", out, 0); err != nil {
+			t.Error(fmt.Sprintf("InstrumentFile(%q) does not parse: %v", ift.body, err))
+		}
+	}
+}
+
+type CDTest struct {
+	line       string
+	constraint string
+	verb       string
+	value      string
+	ok         bool
+}
+
+func TestParseCgoDirective(t *testing.T) {
+	cdTests := []CDTest{
+		{"#cgo CFLAGS: -DX=1", "", "CFLAGS", "-DX=1", true},
+		{"#cgo linux,amd64 LDFLAGS: -lm -lz", "linux,amd64", "LDFLAGS", "-lm -lz", true},
+		{"#cgo !windows darwin pkg-config: zlib", "!windows darwin", "pkg-config", "zlib", true},
+		{"#cgo linux CFLAGS -O2", "", "", "", false},
+		{"#cgo : -O2", "", "", "", false},
+		{"#cgo linux CXXFLAGS: -O2", "", "", "", false},
+		{"#cgo lin/ux CFLAGS: -O2", "", "", "", false},
+		{"#cgo linux,,amd64 CFLAGS: -O2", "", "", "", false},
+	}
+
+	for _, cdt := range cdTests {
+		constraint, verb, value, err := ParseCgoDirective(cdt.line)
+		if (err == nil) != cdt.ok {
+			t.Error(fmt.Sprintf("ParseCgoDirective(%q) -> error %v, was expecting ok=%v", cdt.line, err, cdt.ok))
+			continue
+		}
+		if cdt.ok && (constraint != cdt.constraint || verb != cdt.verb || value != cdt.value) {
+			t.Error(fmt.Sprintf("ParseCgoDirective(%q) -> %q, %q, %q, was expecting %q, %q, %q", cdt.line, constraint, verb, value, cdt.constraint, cdt.verb, cdt.value))
+		}
+	}
+}
+
+func TestFindDiagnostics(t *testing.T) {
+	output := "(in p) building pkg \"p\"\n" +
+		"m.go:6:17: undefined: x\n" +
+		"n.go:2:1: undefined: y\n" +
+		"gb warning: /ws/p/m.go:3: malformed #cgo directive\n" +
+		"(in p) could not build \"p\"\n"
+	diags := FindDiagnostics(output, "/ws/p/m.go")
+	expected := "[{/ws/p/m.go 6 17 undefined: x} {/ws/p/m.go 3 0 malformed #cgo directive}]"
+	if fmt.Sprint(diags) != expected {
+		t.Error(fmt.Sprintf("FindDiagnostics -> %v, was expecting %s", diags, expected))
+	}
+}
+
+type SQTest struct {
+	text  string
+	words string
+	ok    bool
+}
+
+func TestSplitQuoted(t *testing.T) {
+	sqTests := []SQTest{
+		{`-D "some path"`, `[-D some path]`, true},
+		{`'a "b"' c\ d`, `[a "b" c d]`, true},
+		{`"a \"b\""`, `[a "b"]`, true},
+		{`x"y z"`, `[xy z]`, true},
+		{`"unclosed`, ``, false},
+	}
+
+	for _, sqt := range sqTests {
+		words, err := SplitQuoted(sqt.text)
+		if (err == nil) != sqt.ok {
+			t.Error(fmt.Sprintf("SplitQuoted(%q) -> error %v, was expecting ok=%v", sqt.text, err, sqt.ok))
+			continue
+		}
+		if sqt.ok && fmt.Sprint(words) != sqt.words {
+			t.Error(fmt.Sprintf("SplitQuoted(%q) -> %v, was expecting %s", sqt.text, words, sqt.words))
+		}
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	os.Setenv("GBTESTVAR", "v")
+	os.Setenv("GBTESTSPACE", "a b")
+	text := "# a comment\n" +
+		"gcflags=-D \"some path\" -I $GBTESTSPACE/include # trailing\n" +
+		"pkgdir=$GBTESTSPACE/'my #dir'\n" +
+		"!tags\n" +
+		"tags=a \\\n" +
+		"  b_$GBTESTVAR ${GBTESTVAR}x $$y '$GBTESTVAR'\n" +
+		"nonsense\n" +
+		"colour=blue\n" +
+		"target=two words\n" +
+		"!target\n" +
+		"testtimeout=5s\n" +
+		"!testtimeout\n"
+	cfg, sources, errs := ParseConfig("gb.cfg", []byte(text))
+
+	expected := map[string]string{
+		"gcflags":      `-D 'some path' -I 'a b/include'`,
+		"pkgdir":       "a b/my #dir",
+		"tags":         "a b_v vx $y $GBTESTVAR",
+		"!testtimeout": "",
+	}
+	if len(cfg) != len(expected) {
+		t.Error(fmt.Sprintf("ParseConfig -> %v, was expecting %v", cfg, expected))
+	}
+	for key, value := range expected {
+		if v, ok := cfg[key]; !ok || v != value {
+			t.Error(fmt.Sprintf("ParseConfig -> %s=%q, was expecting %q", key, v, value))
+		}
+	}
+	if sources["tags"] != "gb.cfg:5" {
+		t.Error(fmt.Sprintf("ParseConfig -> tags from %s, was expecting gb.cfg:5", sources["tags"]))
+	}
+
+	expectedErrs := []string{"gb.cfg:7:", "gb.cfg:8:", "gb.cfg:9:", "gb.cfg:10:"}
+	if len(errs) != len(expectedErrs) {
+		t.Error(fmt.Sprintf("ParseConfig -> errors %v, was expecting %d", errs, len(expectedErrs)))
+		return
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), expectedErrs[i]) {
+			t.Error(fmt.Sprintf("ParseConfig -> error %v, was expecting it on %s", err, expectedErrs[i]))
+		}
+	}
+}
+
+type IGTest struct {
+	path    string
+	isDir   bool
+	ignored bool
+}
+
+func TestIgnoreList(t *testing.T) {
+	text := "# generated and vendored code\n" +
+		"vendor/\n" +
+		"*_gen.go\n" +
+		"!keep_gen.go\n" +
+		"/tools\n" +
+		"docs/**/examples\n" +
+		"\\!bang\n" +
+		"[z-a\n" +
+		"!\n"
+	list, errs := ParseIgnore(".gbignore", []byte(text))
+	if len(errs) != 2 || !strings.HasPrefix(errs[0].Error(), ".gbignore:8:") || !strings.HasPrefix(errs[1].Error(), ".gbignore:9:") {
+		t.Error(fmt.Sprintf("ParseIgnore -> errors %v, was expecting them on lines 8 and 9", errs))
+	}
+
+	igTests := []IGTest{
+		{"vendor", true, true},
+		{"a/b/vendor", true, true},
+		{"a/vendor", false, false},
+		{"a/x_gen.go", false, true},
+		{"a/keep_gen.go", false, false},
+		{"tools", true, true},
+		{"a/tools", true, false},
+		{"docs/examples", true, true},
+		{"docs/a/b/examples", true, true},
+		{"a/docs/examples", true, false},
+		{"!bang", false, true},
+		{".", true, false},
+		{"../vendor", true, false},
+	}
+
+	for _, igt := range igTests {
+		if ignored := list.Match(igt.path, igt.isDir); ignored != igt.ignored {
+			t.Error(fmt.Sprintf("Match(%q, %v) -> %v, was expecting %v", igt.path, igt.isDir, ignored, igt.ignored))
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	words := []string{"gcc", "-o", "a b.o", "-DX=\"y\"", "it's", "", "$HOME"}
+	expected := `gcc -o 'a b.o' '-DX="y"' 'it'\''s' '' '$HOME'`
+	if quoted := ShellQuote(words); quoted != expected {
+		t.Error(fmt.Sprintf("ShellQuote(%q) -> %s, was expecting %s", words, quoted, expected))
+	}
+}
+
+func TestFingerprintChange(t *testing.T) {
+	before := Fingerprint{"src:a.go": "1", "src:b.go": "2", "flags:gcflags": "", "env:GOOS": "linux"}
+	after := Fingerprint{"src:a.go": "3", "src:c.go": "4", "flags:gcflags": "-N", "env:GOOS": "darwin"}
+	expected := map[string]string{
+		"src:a.go":      "source a.go changed since the last build",
+		"src:b.go":      "source b.go removed",
+		"src:c.go":      "source c.go added",
+		"flags:gcflags": `gcflags flags changed from "" to "-N"`,
+		"env:GOOS":      "$GOOS changed from linux to darwin",
+	}
+	for key, truth := range expected {
+		if change := FingerprintChange(key, before, after); change != truth {
+			t.Error(fmt.Sprintf("FingerprintChange(%q) -> %q, was expecting %q", key, change, truth))
+		}
+	}
+}
+
+// a TestMain that calls os.Exit never returns to the testmain, so the counts
+// have to be written from inside m.Run
+func TestCoverTestMainExit(t *testing.T) {
+	tools := &GoToolchain{}
+	if err := tools.FindTools(); err != nil {
+		t.Skip("no go command to build with")
+	}
+	wd, err := ioutil.TempDir("", "gbcover")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wd)
+
+	oldGOOS, oldGOARCH, oldGOROOT, oldCWD := GOOS, GOARCH, GOROOT, CWD
+	GOOS, GOARCH, GOROOT, CWD = runtime.GOOS, runtime.GOARCH, runtime.GOROOT(), wd
+	defer func() {
+		GOOS, GOARCH, GOROOT, CWD = oldGOOS, oldGOARCH, oldGOROOT, oldCWD
+	}()
+
+	src := "package p\n\nfunc F(x int) int {\nif x > 0 {\nreturn 1\n}\nreturn 0\n}\n"
+	out, blocks, err := InstrumentFile("p.go", []byte(src), "GoCover_0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSrc := "package p\n\nimport (\n\t\"os\"\n\t\"testing\"\n)\n\nfunc TestMain(m *testing.M) {\n\tos.Exit(m.Run())\n}\n\nfunc TestF(t *testing.T) {\n\tF(1)\n}\n"
+	os.Mkdir(filepath.Join(wd, "_obj"), 0755)
+	ioutil.WriteFile(filepath.Join(wd, "p.go"), out, 0644)
+	ioutil.WriteFile(filepath.Join(wd, "p_test.go"), []byte(testSrc), 0644)
+
+	profile := &CoverProfile{Target: "p", Dir: wd, Files: []*CoverFile{{Name: "p.go", Var: "GoCover_0", Blocks: blocks}}}
+	suite := &TestSuite{
+		TestPkgs:  []*TestPkg{{PkgAlias: "p", PkgName: "p", PkgTarget: "p", TestFuncs: []string{"TestF"}}},
+		MainStart: true,
+		TestMain:  "p",
+		Cover:     &TestCover{PkgAlias: "p", Counts: "_cover_.out", Files: profile.Files},
+	}
+	fout, err := os.Create(filepath.Join(wd, "_testmain.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = TestmainTemplate.Execute(fout, suite)
+	fout.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	includes := []string{"_obj"}
+	pkg := &Package{Dir: wd, Target: "p", Name: "p"}
+	if err = tools.Compile(pkg, wd, CompileJob{ImportPath: "p", Srcs: []string{"p.go", "p_test.go"}, Obj: filepath.Join("_obj", "p.a")}, os.Stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	if err = tools.Compile(pkg, wd, CompileJob{ImportPath: "main", Srcs: []string{"_testmain.go"}, Obj: "_testmain.o", Includes: includes}, os.Stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	if err = tools.Link(pkg, wd, "_testmain", []string{"_testmain.o"}, includes, nil, os.Stdout, os.Stderr); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(filepath.Join(wd, "_testmain"))
+	cmd.Dir = wd
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal(fmt.Sprintf("test binary failed: %v\n%s", err, output))
+	}
+
+	if err = profile.ReadCounts(filepath.Join(wd, "_cover_.out")); err != nil {
+		t.Fatal(err)
+	}
+	if total, covered := profile.Statements(); total != 3 || covered != 2 {
+		t.Error(fmt.Sprintf("TestMain calling os.Exit covered %d of %d statements, was expecting 2 of 3", covered, total))
+	}
+}
+
+// stubExecutor runs nothing, failing the commands run in the directories in
+// fail, and keeps track of how many commands are running at once
+type stubExecutor struct {
+	*DryRunExecutor
+	fail          map[string]bool
+	lock          sync.Mutex
+	running, most int
+}
+
+func (this *stubExecutor) Run(cmd, wd string, argv []string, stdout, stderr io.Writer, timeout time.Duration) (killed bool, err error) {
+	this.lock.Lock()
+	this.running++
+	if this.running > this.most {
+		this.most = this.running
+	}
+	this.lock.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	this.lock.Lock()
+	this.running--
+	this.lock.Unlock()
+	if this.fail[wd] {
+		err = errors.New(fmt.Sprintf("%s failed in %s", cmd, wd))
+	}
+	return
+}
+
+type BCTest struct {
+	fail   []string
+	jobs   int
+	tested []string
+	built  string
+	broken string
+}
+
+func TestBuildConcurrently(t *testing.T) {
+	// c imports a, d imports b and c, and e imports d
+	imports := map[string][]string{"a": nil, "b": nil, "c": {"a"}, "d": {"b", "c"}, "e": {"d"}}
+	bcTests := []BCTest{
+		{nil, 2, nil, "[a b c d e]", "[]"},
+		{[]string{"a"}, 3, nil, "[b]", `[(in a) could not build "a"]`},
+		{[]string{"b", "c"}, 1, nil, "[a]", `[(in b) could not build "b" (in c) could not build "c"]`},
+		{nil, 2, []string{"d", "e"}, "[a b c d]", "[]"},
+		{[]string{"e"}, 2, []string{"e"}, "[a b c d]", "[]"},
+	}
+
+	oldExec, oldTools, oldMakeCMD, oldMakefiles := Exec, Tools, MakeCMD, Makefiles
+	oldBuilt, oldBroken := BuiltTargets, BrokenMsg
+	Tools, MakeCMD, Makefiles = &GCToolchain{}, "make", true
+	defer func() {
+		Exec, Tools, MakeCMD, Makefiles = oldExec, oldTools, oldMakeCMD, oldMakefiles
+		BuiltTargets, BrokenMsg = oldBuilt, oldBroken
+	}()
+
+	for _, bct := range bcTests {
+		stub := &stubExecutor{DryRunExecutor: NewDryRunExecutor(), fail: make(map[string]bool)}
+		for _, dir := range bct.fail {
+			stub.fail[dir] = true
+		}
+		Exec = stub
+		BuiltTargets, BrokenMsg = nil, nil
+
+		pkgs := make(map[string]*Package)
+		var all []*Package
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			pkg := &Package{Target: name, Dir: name, Name: name, HasMakefile: true, NeedsBuild: true, Active: true}
+			for _, dep := range imports[name] {
+				pkg.DepPkgs = append(pkg.DepPkgs, pkgs[dep])
+			}
+			pkg.TestDepPkgs = pkg.DepPkgs
+			pkgs[name] = pkg
+			all = append(all, pkg)
+		}
+
+		var err error
+		if bct.tested == nil {
+			BuildConcurrently(all, bct.jobs)
+		} else {
+			var tested []*Package
+			for _, name := range bct.tested {
+				tested = append(tested, pkgs[name])
+			}
+			err = TestConcurrently(tested, bct.jobs)
+		}
+
+		failedTest := false
+		for _, name := range bct.tested {
+			failedTest = failedTest || stub.fail[name]
+		}
+		if (err != nil) != failedTest {
+			t.Error(fmt.Sprintf("%v with %v failing -> error %v", bct.tested, bct.fail, err))
+		}
+		if stub.most > bct.jobs {
+			t.Error(fmt.Sprintf("%d commands ran at once with %d jobs", stub.most, bct.jobs))
+		}
+		if built := fmt.Sprint(BuiltTargets); built != bct.built {
+			t.Error(fmt.Sprintf("with %v failing, built %s, was expecting %s", bct.fail, built, bct.built))
+		}
+		if broken := fmt.Sprint(BrokenMsg); broken != bct.broken {
+			t.Error(fmt.Sprintf("with %v failing, broken %s, was expecting %s", bct.fail, broken, bct.broken))
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// GccgoToolchain compiles with gccgo and packs with ar. gccgo finds an import
+// "x/y/z" as x/y/libz.a under its -I directories, so that is what packages are
+// built to, but it does not link the archives of imported packages on its own,
+// so cmds are linked against every archive in the workspace's _obj tree and
+// the GOPATH package directories.
+type GccgoToolchain struct {
+	libgoOnce sync.Once
+	// the library gccgo links the whole standard library from
+	libgo string
+}
+
+func (this *GccgoToolchain) Name() string {
+	return "gccgo"
+}
+
+func (this *GccgoToolchain) FindTools() (err error) {
+	if CompileCMD, err = exec.LookPath("gccgo"); err != nil {
+		err = errors.New("Could not find 'gccgo' in path")
+		return
+	}
+	LinkCMD = CompileCMD
+	if PackCMD, err = exec.LookPath("ar"); err != nil {
+		err = errors.New("Could not find 'ar' in path")
+		return
+	}
+	// gccgo has no use for Plan 9 assembly
+	AsmCMD, CCMD = "", ""
+	// cgo targets complain about this when it is missing
+	CGoCMD, _ = FindTool("go")
+	return
+}
+
+func (this *GccgoToolchain) ObjSuffix() string {
+	return ".o"
+}
+
+func (this *GccgoToolchain) Intermediates() []string {
+	return nil
+}
+
+func (this *GccgoToolchain) ArchiveName(target string) string {
+	dir, base := path.Split(target)
+	return dir + "lib" + base + ".a"
+}
+
+// gccgo has the standard library in libgo, so that is the archive for any
+// package GOROOT has the source of
+func (this *GccgoToolchain) GOROOTArchive(importPath string) (archive string, found bool) {
+	this.libgoOnce.Do(func() {
+		output, err := RunExternalOutput(CompileCMD, CWD, []string{"gccgo", "-print-file-name=libgo.so"})
+		if err == nil && filepath.IsAbs(strings.TrimSpace(string(output))) {
+			this.libgo = strings.TrimSpace(string(output))
+		}
+	})
+	if this.libgo == "" {
+		return
+	}
+	for _, src := range []string{filepath.Join(GOROOT, "src", importPath), filepath.Join(GOROOT, "src", "pkg", importPath)} {
+		if info, err := os.Stat(src); err == nil && info.IsDir() {
+			archive, found = this.libgo, true
+			return
+		}
+	}
+	return
+}
+
+func (this *GccgoToolchain) Compile(pkg *Package, wd string, job CompileJob, stdout, stderr io.Writer) (err error) {
+	argv := []string{"gccgo", "-c"}
+	if job.ImportPath != "main" {
+		argv = append(argv, "-fgo-pkgpath="+job.ImportPath)
+	}
+	for _, inc := range job.Includes {
+		argv = append(argv, "-I", inc)
+	}
+	// $GCFLAGS are meant for 6g, so only the GOPATH directories are passed on
+	argv = append(argv, GOPATH_CFLAGS...)
+	argv = append(argv, "-o", job.Obj)
+	argv = append(argv, job.Flags...)
+	argv = append(argv, job.Srcs...)
+
+	err = RunExternalTo(CompileCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GccgoToolchain) Assemble(pkg *Package, wd, importPath, src, obj string, stdout, stderr io.Writer) (err error) {
+	err = errors.New(fmt.Sprintf("gccgo cannot assemble %s", filepath.Join(wd, src)))
+	return
+}
+
+func (this *GccgoToolchain) Pack(pkg *Package, wd, archive string, objs []string, stdout, stderr io.Writer) (err error) {
+	argv := []string{"ar", "rcs", archive}
+	argv = append(argv, objs...)
+	Exec.Remove(filepath.Join(wd, archive))
+	err = RunExternalTo(PackCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GccgoToolchain) Link(pkg *Package, wd, binary string, objs, includes, ldflags []string, stdout, stderr io.Writer) (err error) {
+	argv := []string{"gccgo", "-o", binary}
+	argv = append(argv, objs...)
+	for _, inc := range includes {
+		argv = append(argv, "-L", inc)
+	}
+	argv = append(argv, GOPATH_LDFLAGS...)
+
+	// an archive earlier in includes, like the test version of a package,
+	// hides the one of the same name later on
+	rels, archives := FindArchives(wd, append(includes, GOPATH_OBJDSTS...))
+	// GNU ld only goes back to an earlier archive inside a group, while ld64
+	// on darwin searches them all again on its own, and has no group options
+	group := GOOS != "darwin"
+	if group {
+		argv = append(argv, "-Wl,--start-group")
+	}
+	for _, rel := range rels {
+		if strings.HasPrefix(path.Base(rel), "lib") {
+			argv = append(argv, archives[rel])
+		}
+	}
+	if group {
+		argv = append(argv, "-Wl,--end-group")
+	}
+	argv = append(argv, ldflags...)
+
+	err = RunExternalTo(LinkCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GccgoToolchain) Cgo(pkg *Package, wd, importPath string, srcs, cflags []string, stdout, stderr io.Writer) (err error) {
+	argv := []string{"go", "tool", "cgo", "-gccgo", "-gccgopkgpath=" + importPath, "-objdir", "_obj", "--", "-I" + GetRelative(wd, pkg.Dir, CWD)}
+	argv = append(argv, cflags...)
+	argv = append(argv, srcs...)
+	err = RunExternalTo(CGoCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GccgoToolchain) CgoImports(pkg *Package, wd, name, dynobj string, stdout, stderr io.Writer) (gofiles, objs []string, err error) {
+	// gccgo links against the C libraries itself, so there is nothing to add
+	return
+}
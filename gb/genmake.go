@@ -30,9 +30,15 @@ type MakeData struct {
 	LocalDeps   []string
 	BuildDirPkg string
 	BuildDirCmd string
-	CopyLocal   bool
 }
 
+// the workspace build directories, as seen by make, which fills in the
+// platform itself
+var (
+	MakeBuildDirPkg = ObjDir + "/$(GOOS)_$(GOARCH)"
+	MakeBuildDirCmd = BinDir + "/$(GOOS)_$(GOARCH)"
+)
+
 var MakeCmdTemplate = template.Must(template.New("MakeCmd").Parse(
 	`# Makefile generated by gb: http://go-gb.googlecode.com
 # gb provides configuration-free building and distributing
@@ -47,8 +53,8 @@ GOFILES=\
 GBROOT={{.GBROOT}}
 
 # gb: compile/link against local install
-GCIMPORTS+= -I $(GBROOT)/_obj
-LDIMPORTS+= -L $(GBROOT)/_obj
+GCIMPORTS+= -I $(GBROOT)/{{.BuildDirPkg}}
+LDIMPORTS+= -L $(GBROOT)/{{.BuildDirPkg}}
 
 # gb: compile/link against GOPATH entries
 GOPATHSEP=:
@@ -66,7 +72,7 @@ include $(GOROOT)/src/Make.cmd
 # gb: copy to local install
 $(GBROOT)/{{.BuildDirCmd}}/$(TARG): $(TARG)
 	mkdir -p $(dir $@); cp -f $< $@
-command: $(GBROOT)/_bin/$(TARG)
+command: $(GBROOT)/{{.BuildDirCmd}}/$(TARG)
 {{if .LocalDeps}}
 # gb: local dependencies{{if $BuildDirPkg=.BuildDirPkg}}
 {{range .LocalDeps}}$(TARG): $(GBROOT)/{{$BuildDirPkg}}/{{.}}.a
@@ -112,15 +118,15 @@ GOPATHSEP=;
 endif
 GCIMPORTS+=-I $(subst $(GOPATHSEP),/pkg/$(GOOS)_$(GOARCH) -I , $(GOPATH))/pkg/$(GOOS)_$(GOARCH)
 LDIMPORTS+=-L $(subst $(GOPATHSEP),/pkg/$(GOOS)_$(GOARCH) -L , $(GOPATH))/pkg/$(GOOS)_$(GOARCH)
-{{if .CopyLocal}}
+
 # gb: copy to local install
-$(GBROOT)/{{.BuildDirPkg}}/$(TARG).a: {{.BuildDirPkg}}/$(TARG).a
+$(GBROOT)/{{.BuildDirPkg}}/$(TARG).a: _obj/$(TARG).a
 	mkdir -p $(dir $@); cp -f $< $@
-{{end}}
+
 package: $(GBROOT)/{{.BuildDirPkg}}/$(TARG).a
 
 include $(GOROOT)/src/Make.pkg
 {{if .LocalDeps}}
 # gb: local dependencies{{if $BuildDirPkg=.BuildDirPkg}}
-{{range .LocalDeps}}{{$BuildDirPkg}}/$(TARG).a: $(GBROOT)/{{$BuildDirPkg}}/{{.}}.a
+{{range .LocalDeps}}_obj/$(TARG).a: $(GBROOT)/{{$BuildDirPkg}}/{{.}}.a
 {{end}}{{end}}{{end}}`))
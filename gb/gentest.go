@@ -20,13 +20,33 @@ import (
 	"text/template"
 )
 
+type TestExample struct {
+	Name, Output string
+	Unordered    bool
+}
+
 type TestPkg struct {
 	PkgAlias, PkgName, PkgTarget string
 	TestFuncs, TestBenchmarks    []string
+	TestExamples                 []TestExample
 }
 
 type TestSuite struct {
 	TestPkgs []*TestPkg
+	// start the tests with testing.MainStart, which only the go toolchain
+	// has, rather than testing.Main
+	MainStart bool
+	// the alias of the package with a TestMain, if there is one
+	TestMain string
+	// with --cover, the counters to write out once the tests are done,
+	// even if a TestMain exits without returning
+	Cover *TestCover
+}
+
+type TestCover struct {
+	// the alias of the instrumented package, and where to write the counts
+	PkgAlias, Counts string
+	Files            []*CoverFile
 }
 
 var TestmainTemplate = template.Must(template.New("TestSource").Parse(
@@ -36,7 +56,10 @@ var TestmainTemplate = template.Must(template.New("TestSource").Parse(
 {{end}}
 import "testing"
 import __regexp__ "regexp"
-
+{{if .MainStart}}import __os__ "os"
+import __testdeps__ "testing/internal/testdeps"
+{{end}}{{if or .TestMain .Cover}}import __fmt__ "fmt"
+{{end}}
 var tests = []testing.InternalTest{
 {{range .TestPkgs}}{{if $PkgName=.PkgName}}{{if $PkgAlias=.PkgAlias}}{{range .TestFuncs}}	{"{{$PkgName}}.{{.}}", {{$PkgAlias}}.{{.}}},{{end}}{{end}}{{end}}{{end}}
 }
@@ -45,6 +68,10 @@ var benchmarks = []testing.InternalBenchmark{
 {{range .TestPkgs}}{{if $PkgName=.PkgName}}{{if $PkgAlias=.PkgAlias}}{{range .TestBenchmarks}}	{"{{$PkgName}}.{{.}}", {{$PkgAlias}}.{{.}}},{{end}}{{end}}{{end}}{{end}}
 }
 
+var examples = []testing.InternalExample{
+{{range .TestPkgs}}{{if $PkgName=.PkgName}}{{if $PkgAlias=.PkgAlias}}{{range .TestExamples}}	{Name: "{{$PkgName}}.{{.Name}}", F: {{$PkgAlias}}.{{.Name}}, Output: {{printf "%q" .Output}}{{if .Unordered}}, Unordered: true{{end}}},{{end}}{{end}}{{end}}{{end}}
+}
+
 var matchPat string
 var matchRe *__regexp__.Regexp
 
@@ -59,7 +86,37 @@ func matchString(pat, str string) (result bool, err error) {
 	return matchRe.MatchString(str), nil
 }
 
-func main() {
-	testing.Main(matchString, tests, benchmarks, []testing.InternalExample{})
+{{if .Cover}}func writeCoverCounts(string, string) (string, error) {
+	fout, err := __os__.Create({{printf "%q" .Cover.Counts}})
+	if err != nil {
+		__fmt__.Fprintf(__os__.Stderr, "%v\n", err)
+		return "", nil
+	}
+	defer fout.Close()
+{{range .Cover.Files}}	for i, count := range {{$.Cover.PkgAlias}}.{{.Var}}.Count {
+		__fmt__.Fprintf(fout, "%s %d %d\n", {{printf "%q" .Name}}, i, count)
+	}
+{{end}}	return "", nil
+}
+
+// m.Run calls the tear down it gets here once the tests are done, before
+// a TestMain gets the chance to os.Exit
+type coverDeps struct {
+	__testdeps__.TestDeps
 }
+
+func (coverDeps) InitRuntimeCoverage() (string, func(string, string) (string, error), func() float64) {
+	return "set", writeCoverCounts, func() float64 { return 0 }
+}
+
+{{end}}func main() {
+{{if .MainStart}}	m := testing.MainStart({{if .Cover}}coverDeps{}{{else}}__testdeps__.TestDeps{}{{end}}, tests, benchmarks, nil, examples)
+{{if .TestMain}}	{{.TestMain}}.TestMain(m)
+	// TestMain hands what m.Run returns to os.Exit, so the result of the
+	// tests is lost if it returns
+	__fmt__.Fprintf(__os__.Stderr, "TestMain returned without calling os.Exit\n")
+	__os__.Exit(1)
+{{else}}	__os__.Exit(m.Run())
+{{end}}{{else}}	testing.Main(matchString, tests, benchmarks, examples)
+{{end}}}
 `))
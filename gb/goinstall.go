@@ -21,6 +21,7 @@ import (
 	"path"
 	"regexp"
 	"strings"
+	"sync"
 )
 
 var disabledGCRE = regexp.MustCompile(`^([a-z0-9\-]+\.googlecode\.com/(svn|hg))(/[a-z0-9A-Z_.\-/]*)?$`)
@@ -36,6 +37,7 @@ var goinstallables = []*regexp.Regexp{
 }
 
 var goinstalledAlready = make(map[string]bool)
+var goinstallLock sync.Mutex
 
 func IsGoInstallable(target string) (matches bool) {
 	target = strings.Trim(target, "\"")
@@ -51,6 +53,9 @@ func IsGoInstallable(target string) (matches bool) {
 }
 
 func GoInstallPkg(target string) (touched int64) {
+	goinstallLock.Lock()
+	defer goinstallLock.Unlock()
+
 	if goinstalledAlready[target] {
 		return
 	}
@@ -79,7 +84,7 @@ func GoInstallPkg(target string) (touched int64) {
 		return
 	}
 
-	goinstalledFile := path.Join(GetInstallDirPkg(), target) + ".a"
+	goinstalledFile := path.Join(GetInstallDirPkg(), Tools.ArchiveName(target))
 
 	touched, _ = StatTime(goinstalledFile)
 	return
@@ -0,0 +1,170 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var GraphColors = map[string]string{
+	"cmd":      "lightblue",
+	"pkg":      "white",
+	"cgo":      "orange",
+	"protobuf": "palegreen",
+}
+
+func (this *Package) graphID() string {
+	if this.IsCmd {
+		return strconv.Quote(this.Target + "-cmd")
+	}
+	return strconv.Quote(this.Target)
+}
+
+func (this *Package) graphKind() string {
+	switch {
+	case this.IsCmd:
+		return "cmd"
+	case this.IsCGo:
+		return "cgo"
+	case this.IsProtobuf:
+		return "protobuf"
+	}
+	return "pkg"
+}
+
+// WriteGraph writes the dependency graph reachable from roots in the DOT
+// language. Targets further than depth imports away from a root are left out,
+// unless depth is 0. Imports satisfied from GOROOT or by goinstall are drawn
+// as external nodes, and imports only made by tests are drawn dashed.
+func WriteGraph(w io.Writer, roots []*Package, depth int) (err error) {
+	level := make(map[*Package]int)
+	var order []*Package
+
+	var visit func(pkg *Package, d int)
+	visit = func(pkg *Package, d int) {
+		if l, ok := level[pkg]; ok && l <= d {
+			return
+		}
+		if _, ok := level[pkg]; !ok {
+			order = append(order, pkg)
+		}
+		level[pkg] = d
+		if depth != 0 && d >= depth {
+			return
+		}
+		for _, dep := range pkg.DepPkgs {
+			visit(dep, d+1)
+		}
+		for _, dep := range pkg.TestDepPkgs {
+			visit(dep, d+1)
+		}
+	}
+	for _, pkg := range roots {
+		visit(pkg, 0)
+	}
+	sort.Sort(byTarget(order))
+
+	fmt.Fprintf(w, "digraph gb {\n")
+	fmt.Fprintf(w, "\tnode [shape=box, style=filled];\n")
+
+	for _, pkg := range order {
+		style := "filled"
+		if pkg.InTestData != "" {
+			style = "filled,dashed"
+		}
+		fmt.Fprintf(w, "\t%s [label=%s, fillcolor=%s, style=%q];\n",
+			pkg.graphID(), strconv.Quote(pkg.Target), GraphColors[pkg.graphKind()], style)
+	}
+
+	external := make(map[string]string)
+
+	for _, pkg := range order {
+		if depth != 0 && level[pkg] >= depth {
+			continue
+		}
+		linked := make(map[*Package]bool)
+		for _, dep := range pkg.DepPkgs {
+			linked[dep] = true
+			fmt.Fprintf(w, "\t%s -> %s;\n", pkg.graphID(), dep.graphID())
+		}
+		for _, dep := range pkg.TestDepPkgs {
+			// external tests import the package they test
+			if linked[dep] || dep == pkg {
+				continue
+			}
+			linked[dep] = true
+			fmt.Fprintf(w, "\t%s -> %s [style=dashed];\n", pkg.graphID(), dep.graphID())
+		}
+
+		drawExternal := func(deps []string, edgeStyle string) {
+			for _, dep := range deps {
+				if _, ok := Packages[dep]; ok || dep == "\"C\"" {
+					continue
+				}
+				// the cgo tool, which is only a target when building GOROOT
+				if strings.HasSuffix(dep, "-cmd") {
+					continue
+				}
+				target := UnquoteDep(dep)
+				if exists, _ := PkgExistsInGOROOT(dep); exists {
+					external[target] = "GOROOT"
+				} else if IsGoInstallable(dep) {
+					external[target] = "goinstall"
+				} else {
+					external[target] = "unresolved"
+				}
+				fmt.Fprintf(w, "\t%s -> %s%s;\n", pkg.graphID(), strconv.Quote("ext:"+target), edgeStyle)
+			}
+		}
+		drawExternal(pkg.Deps, "")
+		var testOnly []string
+		for _, dep := range pkg.TestDeps {
+			found := false
+			for _, d := range pkg.Deps {
+				found = found || d == dep
+			}
+			if !found {
+				testOnly = append(testOnly, dep)
+			}
+		}
+		drawExternal(testOnly, " [style=dashed]")
+	}
+
+	var externals []string
+	for target := range external {
+		externals = append(externals, target)
+	}
+	sort.Strings(externals)
+	for _, target := range externals {
+		color := "gray"
+		switch external[target] {
+		case "goinstall":
+			color = "gold"
+		case "unresolved":
+			color = "red"
+		}
+		fmt.Fprintf(w, "\t%s [label=%s, shape=ellipse, style=\"\", color=%s];\n",
+			strconv.Quote("ext:"+target), strconv.Quote(target+" ("+external[target]+")"), color)
+	}
+
+	_, err = fmt.Fprintf(w, "}\n")
+	return
+}
@@ -0,0 +1,179 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// the file in the workspace's root that lists what gb should not look at
+const IgnoreFile = ".gbignore"
+
+// IgnorePattern is one line of a .gbignore file.
+type IgnorePattern struct {
+	// the glob, with its leading slash and trailing slash removed
+	Pattern string
+	// a line starting with ! brings back what an earlier line ignored
+	Negate bool
+	// a pattern ending in / only matches directories
+	DirOnly bool
+	// a pattern with a / in it is matched against the whole path from the
+	// workspace's root, otherwise against the last element of the path
+	Anchored bool
+}
+
+// IgnoreList holds the patterns of a .gbignore file, in order.
+type IgnoreList []IgnorePattern
+
+// the patterns read from the workspace's .gbignore
+var WorkspaceIgnore IgnoreList
+
+// LoadIgnore reads the workspace's .gbignore, reporting any problems with it.
+func LoadIgnore() {
+	text, err := ioutil.ReadFile(IgnoreFile)
+	if err != nil && !os.IsNotExist(err) {
+		ErrLog.Println(err)
+	}
+	var errs []error
+	WorkspaceIgnore, errs = ParseIgnore(IgnoreFile, text)
+	for _, err := range errs {
+		ErrLog.Println(err)
+	}
+}
+
+// ParseIgnore reads the text of the .gbignore file at path. It takes the
+// patterns of a .gitignore: blank lines and lines starting with # are skipped,
+// * and ? match within a path element, ** matches any number of them, and \
+// escapes a leading # or !. Every problem is reported, with its line, in errs.
+func ParseIgnore(path string, text []byte) (list IgnoreList, errs []error) {
+	for i, line := range strings.Split(string(text), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var p IgnorePattern
+		if strings.HasPrefix(line, "!") {
+			p.Negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, "\\#") || strings.HasPrefix(line, "\\!") {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.DirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.HasPrefix(line, "/") {
+			p.Anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		p.Anchored = p.Anchored || strings.Contains(line, "/")
+		p.Pattern = line
+
+		if err := p.validate(); err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s:%d: %v", path, i+1, err)))
+			continue
+		}
+		list = append(list, p)
+	}
+	return
+}
+
+func (this IgnorePattern) validate() (err error) {
+	if this.Pattern == "" {
+		err = errors.New("empty pattern")
+		return
+	}
+	for _, elem := range strings.Split(this.Pattern, "/") {
+		if elem == "" {
+			err = errors.New(fmt.Sprintf("empty path element in %q", this.Pattern))
+			return
+		}
+		if _, merr := path.Match(elem, ""); merr != nil {
+			err = errors.New(fmt.Sprintf("malformed pattern %q", this.Pattern))
+			return
+		}
+	}
+	return
+}
+
+// Match says whether the patterns ignore the file or directory at rel, a path
+// relative to the workspace's root. As with .gitignore, the last pattern that
+// matches decides. Paths outside the workspace are never ignored.
+func (this IgnoreList) Match(rel string, isDir bool) (ignored bool) {
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	if rel == "." || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, "../") {
+		return
+	}
+	elems := strings.Split(rel, "/")
+	for _, p := range this {
+		if p.DirOnly && !isDir {
+			continue
+		}
+		if p.matches(elems) {
+			ignored = !p.Negate
+		}
+	}
+	return
+}
+
+func (this IgnorePattern) matches(elems []string) bool {
+	if !this.Anchored {
+		ok, _ := path.Match(this.Pattern, elems[len(elems)-1])
+		return ok
+	}
+	return matchElems(strings.Split(this.Pattern, "/"), elems)
+}
+
+// match path elements against pattern elements, where ** matches any number
+// of path elements
+func matchElems(pattern, elems []string) bool {
+	if len(pattern) == 0 {
+		return len(elems) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			if matchElems(pattern[1:], elems[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(elems) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], elems[0]); !ok {
+		return false
+	}
+	return matchElems(pattern[1:], elems[1:])
+}
+
+// IgnoredDir says whether gb should stay out of dir, either because of its
+// name or because the workspace's .gbignore says so.
+func IgnoredDir(dir string) bool {
+	_, name := filepath.Split(dir)
+	if DisallowedSourceDirectories[name] || (name != "." && strings.HasPrefix(name, ".")) {
+		return true
+	}
+	return WorkspaceIgnore.Match(dir, true)
+}
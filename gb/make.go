@@ -18,6 +18,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 )
 
 func MakeBuild(pkg *Package) (err error) {
@@ -57,10 +58,10 @@ func MakeClean(pkg *Package) (err error) {
 	return
 }
 
-func MakeTest(pkg *Package) (err error) {
+func MakeTest(pkg *Package, stdout, stderr io.Writer) (err error) {
 	margs := []string{"gomake", "test"}
-	fmt.Printf("(in %v)\n", pkg.Dir)
-	fmt.Printf("%v\n", margs)
-	err = RunExternal(MakeCMD, pkg.Dir, margs)
+	fmt.Fprintf(stdout, "(in %v)\n", pkg.Dir)
+	fmt.Fprintf(stdout, "%v\n", margs)
+	err = RunExternalTo(MakeCMD, pkg.Dir, margs, stdout, stderr)
 	return
 }
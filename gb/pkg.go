@@ -20,6 +20,7 @@ import (
 	//"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -30,7 +31,9 @@ import (
 type Package struct {
 	Dir, Base string
 
-	Cfg Config
+	// the target's gb.cfg settings, with the ones it inherits
+	Cfg        Config
+	CfgSources ConfigSources
 
 	Name, Target string
 
@@ -47,6 +50,9 @@ type Package struct {
 
 	NeedsBuild, NeedsInstall, NeedsGoInstall bool
 
+	// set once the target has been rebuilt, or with -n would have been
+	rebuilt bool
+
 	GoSources  []string
 	CGoSources []string
 	CSrcs      []string
@@ -56,6 +62,8 @@ type Package struct {
 	Sources    []string // the list of all .go, .c, .s source in the target
 
 	Parent *Package // this package's direct ancestor, or nil if it is the workspace
+	// the base the directory was scanned with, before any target override
+	scanBase string
 
 	ProtoGoSrcs []string // the .go files that correspond to .proto files
 	DeadSources []string // all .go, .c, .s files that will not be included in the build
@@ -65,6 +73,8 @@ type Package struct {
 	PkgSrc    map[string][]string
 	TestSrc   map[string][]string
 	PkgCGoSrc map[string][]string
+	// the test sources, also in TestSrc, that import "C"
+	TestCGoSrc map[string][]string
 
 	SrcDeps map[string][]string
 	Deps    []string
@@ -73,10 +83,18 @@ type Package struct {
 	TestSources []string
 	TestDeps    []string
 	TestFuncs   map[string][]string
-	TestDepPkgs []*Package
+	// the examples with output to check, by package name like TestFuncs
+	TestExamples map[string][]TestExample
+	TestDepPkgs  []*Package
 
 	CGoCFlags  map[string][]string
 	CGoLDFlags map[string][]string
+	// the libraries named by #cgo pkg-config directives
+	CGoPkgConfig map[string][]string
+	// the #cgo flags of the test sources, which only apply to the tests
+	TestCGoCFlags    map[string][]string
+	TestCGoLDFlags   map[string][]string
+	TestCGoPkgConfig map[string][]string
 
 	HasMakefile     bool
 	MustUseMakefile bool
@@ -88,8 +106,7 @@ type Package struct {
 
 	FailedToBuild bool
 
-	//to make sure that only one thread works on a given package at a time
-	block chan bool
+	fingerprint Fingerprint
 }
 
 func NewPackage(base, dir string, inTestData string, parent *Package, cfg Config) (this *Package, err error) {
@@ -103,17 +120,23 @@ func NewPackage(base, dir string, inTestData string, parent *Package, cfg Config
 
 	this.Cfg = cfg
 
-	this.block = make(chan bool, 1)
 	this.Parent = parent
+	this.scanBase = base
 	this.Dir = path.Clean(dir)
 	this.InTestData = inTestData
 	this.PkgSrc = make(map[string][]string)
 	this.PkgCGoSrc = make(map[string][]string)
 	this.TestSrc = make(map[string][]string)
+	this.TestCGoSrc = make(map[string][]string)
 	this.TestFuncs = make(map[string][]string)
+	this.TestExamples = make(map[string][]TestExample)
 
 	this.CGoCFlags = make(map[string][]string)
 	this.CGoLDFlags = make(map[string][]string)
+	this.TestCGoCFlags = make(map[string][]string)
+	this.TestCGoLDFlags = make(map[string][]string)
+	this.CGoPkgConfig = make(map[string][]string)
+	this.TestCGoPkgConfig = make(map[string][]string)
 
 	if rel := GetRelative(filepath.Join(GOROOT, "src"), dir, CWD); !strings.HasPrefix(rel, "..") && !filepath.IsAbs(rel) {
 		this.IsInGOROOT = true
@@ -193,6 +216,9 @@ func NewPackage(base, dir string, inTestData string, parent *Package, cfg Config
 	}
 	this.IsCmd = this.Name == "main"
 	this.Objects = append(this.Objects, path.Join(this.Dir, GetIBName()))
+	for _, name := range Tools.Intermediates() {
+		this.Objects = append(this.Objects, path.Join(this.Dir, name))
+	}
 	err = this.GetTarget()
 
 	if reqOS, ok := OSFiltersMust[this.Target]; ok && reqOS != GOOS {
@@ -229,17 +255,20 @@ func NewPackage(base, dir string, inTestData string, parent *Package, cfg Config
 		return
 	}
 
-	if this.IsCmd && this.IsCGo {
-		err = errors.New(fmt.Sprintf("(in %s) cannot have a cgo cmd", this.Dir))
-		ErrLog.Println(err)
-		return
-	}
-
 	this.Active = (DoCmds && this.IsCmd) || (DoPkgs && !this.IsCmd)
 
 	return
 }
 
+// the key of the target in Packages, which is how imports refer to it
+func (this *Package) packagesKey() (key string) {
+	key = "\"" + this.Target + "\""
+	if this.IsCmd {
+		key += "-cmd"
+	}
+	return
+}
+
 func (this *Package) DetectCycles() (cycle []*Package) {
 	cycle = this.detectCycle(nil)
 	return
@@ -340,6 +369,9 @@ func (this *Package) VisitFile(fpath string, f os.FileInfo) {
 	if strings.HasPrefix(fpath, "#") {
 		return
 	}
+	if WorkspaceIgnore.Match(fpath, false) {
+		return
+	}
 	//skip files generates by the cgo process
 	if strings.HasSuffix(fpath, ".cgo1.go") {
 		return
@@ -378,6 +410,8 @@ func (this *Package) VisitFile(fpath string, f os.FileInfo) {
 		return
 	}
 
+	fullpath := fpath
+
 	rootl := len(this.Dir) + 1
 	if this.Dir != "." {
 		fpath = fpath[rootl:len(fpath)]
@@ -387,6 +421,11 @@ func (this *Package) VisitFile(fpath string, f os.FileInfo) {
 		strings.HasSuffix(fpath, ".c") ||
 		strings.HasSuffix(fpath, ".s") {
 		this.DeadSources = append(this.DeadSources, fpath)
+
+		//skip files whose +build lines aren't satisfied
+		if !ShouldBuildFile(fullpath, this.BuildTags()) {
+			return
+		}
 	}
 
 	if strings.HasSuffix(fpath, ".proto") {
@@ -398,7 +437,7 @@ func (this *Package) VisitFile(fpath string, f os.FileInfo) {
 	}
 	if strings.HasSuffix(fpath, ".s") {
 		this.AsmSrcs = append(this.AsmSrcs, fpath)
-		this.Objects = append(this.Objects, fpath[:len(fpath)-2]+GetObjSuffix())
+		this.Objects = append(this.Objects, path.Join(this.Dir, fpath[:len(fpath)-2]+Tools.ObjSuffix()))
 		this.Sources = append(this.Sources, fpath)
 	}
 	if strings.HasSuffix(fpath, ".go") {
@@ -426,12 +465,13 @@ func (this *Package) GetSourceDeps() (err error) {
 	this.SrcDeps = make(map[string][]string)
 
 	var nonCGoSrc []string
+	tags := this.BuildTags()
 
 	for _, src := range this.GoSources {
 		var fpkg, ftarget string
 		var fdeps []string
-		var cflags, ldflags []string
-		fpkg, ftarget, fdeps, _, cflags, ldflags, err = GetDeps(path.Join(this.Dir, src))
+		var cflags, ldflags, pkgconfig []string
+		fpkg, ftarget, fdeps, _, cflags, ldflags, pkgconfig, _, err = GetDeps(path.Join(this.Dir, src), tags)
 
 		if err != nil {
 			BrokenMsg = append(BrokenMsg, fmt.Sprintf("(in %s) %s", this.Dir, err.Error()))
@@ -461,6 +501,7 @@ func (this *Package) GetSourceDeps() (err error) {
 				this.IsCGo = true
 				this.CGoCFlags[fpkg] = append(this.CGoCFlags[fpkg], cflags...)
 				this.CGoLDFlags[fpkg] = append(this.CGoLDFlags[fpkg], ldflags...)
+				this.CGoPkgConfig[fpkg] = append(this.CGoPkgConfig[fpkg], pkgconfig...)
 			}
 		}
 		if isCGoSrc && !(this.IsInGOROOT &&
@@ -483,6 +524,9 @@ func (this *Package) GetSourceDeps() (err error) {
 	for fpkg, flags := range this.CGoLDFlags {
 		this.CGoLDFlags[fpkg] = RemoveDups(flags)
 	}
+	for fpkg, names := range this.CGoPkgConfig {
+		this.CGoPkgConfig[fpkg] = RemoveDups(names)
+	}
 
 	this.GoSources = nonCGoSrc
 
@@ -500,18 +544,24 @@ func (this *Package) GetSourceDeps() (err error) {
 
 	this.Deps = RemoveDups(this.Deps)
 
-	if Test {
+	if Test || Graph {
 		for _, src := range this.TestSources {
 			var fpkg, ftarget string
 			var fdeps, ffuncs []string
-			fpkg, ftarget, fdeps, ffuncs, _, _, err = GetDeps(path.Join(this.Dir, src))
+			var cflags, ldflags, pkgconfig []string
+			var fexamples []TestExample
+			fpkg, ftarget, fdeps, ffuncs, cflags, ldflags, pkgconfig, fexamples, err = GetDeps(path.Join(this.Dir, src), tags)
 			if this.Name != "\"runtime\"" {
 				fdeps = append(fdeps, "\"runtime\"")
 			}
 			for _, dep := range fdeps {
 				if dep == "\"C\"" {
-					ErrLog.Printf("Test src %s wants to use cgo... too much effort.\n", src)
-					continue
+					this.TestCGoSrc[fpkg] = append(this.TestCGoSrc[fpkg], src)
+					this.TestCGoCFlags[fpkg] = RemoveDups(append(this.TestCGoCFlags[fpkg], cflags...))
+					this.TestCGoLDFlags[fpkg] = RemoveDups(append(this.TestCGoLDFlags[fpkg], ldflags...))
+					this.TestCGoPkgConfig[fpkg] = RemoveDups(append(this.TestCGoPkgConfig[fpkg], pkgconfig...))
+					fdeps = append(fdeps, "\"runtime/cgo\"")
+					break
 				}
 			}
 			this.TestSrc[fpkg] = append(this.TestSrc[fpkg], src)
@@ -524,6 +574,7 @@ func (this *Package) GetSourceDeps() (err error) {
 			}
 			this.TestDeps = append(this.TestDeps, fdeps...)
 			this.TestFuncs[fpkg] = append(this.TestFuncs[fpkg], ffuncs...)
+			this.TestExamples[fpkg] = append(this.TestExamples[fpkg], fexamples...)
 		}
 		this.TestDeps = RemoveDups(this.TestDeps)
 	}
@@ -586,13 +637,8 @@ func (this *Package) GetTarget() (err error) {
 				}
 				fixed := tryFixPrefix(path.Join("src", "pkg")) || tryFixPrefix("pkg") || tryFixPrefix("src")
 
-				for t := this; t != nil; t = t.Parent {
-					if pkgdir, set := t.Cfg.Pkgdir(); set {
-						if !fixed {
-							tryFixPrefix(pkgdir)
-						}
-						break
-					}
+				if pkgdir, set := this.Cfg.Pkgdir(); set && !fixed {
+					tryFixPrefix(pkgdir)
 				}
 			}
 		} else {
@@ -628,14 +674,14 @@ func (this *Package) GetTarget() (err error) {
 		if this.IsCmd {
 			this.InstallPath = filepath.Join(GOBIN, this.Target)
 		} else {
-			this.InstallPath = filepath.Join(GOROOT, "pkg", GOOS+"_"+GOARCH, this.Target+".a")
+			this.InstallPath = filepath.Join(GOROOT, "pkg", GOOS+"_"+GOARCH, Tools.ArchiveName(this.Target))
 		}
 		this.ResultPath = this.InstallPath
 	} else if this.IsInGOPATH != "" && this.InTestData == "" {
 		if this.IsCmd {
 			this.InstallPath = filepath.Join(this.IsInGOPATH, "bin", this.Target)
 		} else {
-			this.InstallPath = filepath.Join(this.IsInGOPATH, "pkg", GOOS+"_"+GOARCH, this.Target+".a")
+			this.InstallPath = filepath.Join(this.IsInGOPATH, "pkg", GOOS+"_"+GOARCH, Tools.ArchiveName(this.Target))
 		}
 		this.ResultPath = this.InstallPath
 	} else {
@@ -648,12 +694,12 @@ func (this *Package) GetTarget() (err error) {
 				this.ResultPath = filepath.Join(GetBuildDirCmd(), this.Target)
 			}
 		} else {
-			this.InstallPath = filepath.Join(GetInstallDirPkg(), this.Target+".a")
+			this.InstallPath = filepath.Join(GetInstallDirPkg(), Tools.ArchiveName(this.Target))
 			if this.InTestData != "" {
 				buildDirTest := filepath.Join(this.InTestData, GetBuildDirPkg())
-				this.ResultPath = filepath.Join(buildDirTest, this.Target+".a")
+				this.ResultPath = filepath.Join(buildDirTest, Tools.ArchiveName(this.Target))
 			} else {
-				this.ResultPath = filepath.Join(GetBuildDirPkg(), this.Target+".a")
+				this.ResultPath = filepath.Join(GetBuildDirPkg(), Tools.ArchiveName(this.Target))
 			}
 		}
 	}
@@ -684,6 +730,11 @@ func (this *Package) PrintScan() {
 		pkg.PrintScan()
 	}
 
+	if ScanJSON {
+		this.PrintScanJSON()
+		return
+	}
+
 	//build, install := this.Touched()
 	bis := ""
 	if !this.NeedsBuild {
@@ -761,7 +812,10 @@ func (this *Package) ResolveDeps() (err error) {
 	CheckDeps := func(deps []string, test bool) (err error) {
 		for _, dep := range deps {
 			if dep == "\"C\"" {
-				this.IsCGo = true
+				// cgo in the tests doesn't make the target a cgo one
+				if !test {
+					this.IsCGo = true
+				}
 				continue
 			}
 			if strings.HasPrefix(dep, "\"./") {
@@ -840,7 +894,7 @@ func (this *Package) Touched() (build, install bool) {
 		inTime = this.SourceTime
 	}
 
-	if inTime > this.BinTime {
+	if this.Stale(inTime) {
 		build = true
 	}
 	if this.InstTime < this.BinTime || this.InstTime < inTime {
@@ -855,11 +909,12 @@ func (this *Package) Touched() (build, install bool) {
 }
 
 func (this *Package) Build() (err error) {
-	this.block <- true
-	defer func() {
-		<-this.block
-	}()
+	return this.build(true)
+}
 
+// build brings the target up to date. Unless recurse is set, the caller must
+// already have finished building the target's dependencies.
+func (this *Package) build(recurse bool) (err error) {
 	defer func() {
 		if err != nil {
 			this.FailedToBuild = true
@@ -890,15 +945,12 @@ func (this *Package) Build() (err error) {
 
 	inTime := this.GOROOTPkgTime
 
-	if Concurrent {
-		for _, pkg := range this.DepPkgs {
-			go pkg.Build()
-		}
-	}
-
 	for _, pkg := range this.DepPkgs {
-
-		err = pkg.Build()
+		if recurse {
+			err = pkg.Build()
+		} else if pkg.FailedToBuild {
+			err = errors.New("Cannot build deps")
+		}
 		if err != nil {
 			return
 		}
@@ -925,7 +977,17 @@ func (this *Package) Build() (err error) {
 		inTime = this.SourceTime
 	}
 
-	if inTime > this.BinTime {
+	// deps may have just been rebuilt
+	this.fingerprint = nil
+
+	stale := this.Stale(inTime)
+	for _, pkg := range this.DepPkgs {
+		// with -n the archives of rebuilt dependencies are left as they
+		// were, so they can't show that this target would be rebuilt too
+		stale = stale || (DryRun && pkg.rebuilt)
+	}
+
+	if stale {
 		which := "cmd"
 		if this.Name != "main" {
 			which = "pkg"
@@ -950,10 +1012,14 @@ func (this *Package) Build() (err error) {
 			}
 		}
 		if err == nil {
-			PackagesBuilt++
+			this.rebuilt = true
+			ReportBuilt(this.Target)
+			if ferr := this.SaveFingerprint(); ferr != nil {
+				WarnLog.Printf("(in %s) could not save fingerprint: %v", this.Dir, ferr)
+			}
 		} else {
-			BrokenPackages++
-			BrokenMsg = append(BrokenMsg, fmt.Sprintf("(in %s) could not build \"%s\"", this.Dir, this.Target))
+			Count(&BrokenPackages)
+			ReportBroken(fmt.Sprintf("(in %s) could not build \"%s\"", this.Dir, this.Target))
 		}
 
 	}
@@ -971,6 +1037,16 @@ func (this *Package) Build() (err error) {
 	return
 }
 func (this *Package) Test() (err error) {
+	err = this.PrepareTest()
+	if err != nil {
+		return
+	}
+	err = this.TestTo(os.Stdout, os.Stderr)
+	return
+}
+
+// PrepareTest brings everything the tests import up to date.
+func (this *Package) PrepareTest() (err error) {
 	for _, pkg := range this.TestDepPkgs {
 		err = pkg.Build()
 		if err != nil {
@@ -984,9 +1060,14 @@ func (this *Package) Test() (err error) {
 			}
 		}
 	}
+	return
+}
 
-	if (Makefiles && this.HasMakefile) || this.IsCGo {
-		err = MakeTest(this)
+// TestTo builds and runs the tests, once PrepareTest is done, with the test
+// binary's output going to stdout and stderr.
+func (this *Package) TestTo(stdout, stderr io.Writer) (err error) {
+	if (Makefiles && this.HasMakefile) || (this.IsCGo && !TestCGO) {
+		err = MakeTest(this, stdout, stderr)
 		return
 	}
 
@@ -994,76 +1075,86 @@ func (this *Package) Test() (err error) {
 	if !MakeAMess {
 		defer func() {
 			if Verbose {
-				fmt.Printf(" Removing %s\n", testdir)
+				fmt.Fprintf(stdout, " Removing %s\n", testdir)
 			}
-			err = os.RemoveAll(testdir)
+			err = Exec.RemoveAll(testdir)
 		}()
 	}
 
-	fmt.Printf("(in %s) testing \"%s\"\n", this.Dir, this.Target)
-
-	var pkgtests, pkgbenchmarks map[string][]string
-	pkgtests = make(map[string][]string)
-	pkgbenchmarks = make(map[string][]string)
-
-	for name, funcs := range this.TestFuncs {
-		for _, f := range funcs {
-			if strings.HasPrefix(f, "Test") {
-				pkgtests[name] = append(pkgtests[name], f)
-			}
-			if strings.HasPrefix(f, "Benchmark") {
-				pkgbenchmarks[name] = append(pkgbenchmarks[name], f)
-			}
-		}
-	}
-
-	testsrc := path.Join(this.Dir, "_test", "_testmain.go")
-	dstDir, _ := path.Split(testsrc)
-	os.MkdirAll(dstDir, 0755)
-	file, err := os.Create(testsrc)
-
-	if err != nil {
-		return
-	}
+	fmt.Fprintf(stdout, "(in %s) testing \"%s\"\n", this.Dir, this.Target)
 
 	testSuite := &TestSuite{}
+	_, testSuite.MainStart = Tools.(*GoToolchain)
 
 	testpkgMap := make(map[string]*TestPkg)
 
-	for name, tests := range pkgtests {
-		if _, ok := testpkgMap[name]; !ok {
+	getTestPkg := func(name string) (tpkg *TestPkg) {
+		if tpkg = testpkgMap[name]; tpkg == nil {
 			targ := name
 
 			if name == this.Name {
 				targ = this.Target
 			}
-			testpkgMap[name] = &TestPkg{
+			tpkg = &TestPkg{
 				PkgAlias:  name,
 				PkgName:   name,
 				PkgTarget: targ,
 			}
+			testpkgMap[name] = tpkg
 		}
-
-		tpkg := testpkgMap[name]
-
-		for _, test := range tests {
-			tpkg.TestFuncs = append(tpkg.TestFuncs, test)
-		}
+		return
 	}
 
-	for name, benchmarks := range pkgbenchmarks {
-		if _, ok := testpkgMap[name]; !ok {
-			testpkgMap[name] = &TestPkg{
-				PkgAlias: name,
-				PkgName:  name,
+	var testMainPkg *TestPkg
+	for name, funcs := range this.TestFuncs {
+		for _, f := range funcs {
+			if f == "TestMain" {
+				if testMainPkg != nil {
+					err = errors.New(fmt.Sprintf("(in %s) more than one TestMain", this.Dir))
+					ErrLog.Println(err)
+					ReportFailed()
+					return
+				}
+				if !testSuite.MainStart {
+					err = errors.New(fmt.Sprintf("(in %s) TestMain needs the \"go\" toolchain", this.Dir))
+					ErrLog.Println(err)
+					ReportFailed()
+					return
+				}
+				testMainPkg = getTestPkg(name)
+			} else if strings.HasPrefix(f, "Test") {
+				tpkg := getTestPkg(name)
+				tpkg.TestFuncs = append(tpkg.TestFuncs, f)
+			} else if strings.HasPrefix(f, "Benchmark") {
+				tpkg := getTestPkg(name)
+				tpkg.TestBenchmarks = append(tpkg.TestBenchmarks, f)
 			}
 		}
+	}
 
-		tpkg := testpkgMap[name]
+	for name, examples := range this.TestExamples {
+		tpkg := getTestPkg(name)
+		tpkg.TestExamples = append(tpkg.TestExamples, examples...)
+	}
 
-		for _, benchmark := range benchmarks {
-			tpkg.TestBenchmarks = append(tpkg.TestBenchmarks, benchmark)
+	pkgSrc := this.PkgSrc[this.Name]
+	var profile *CoverProfile
+	var coverPkg *TestPkg
+	if Cover {
+		if !testSuite.MainStart {
+			err = errors.New(fmt.Sprintf("(in %s) --cover needs the \"go\" toolchain", this.Dir))
+			ErrLog.Println(err)
+			ReportFailed()
+			return
+		}
+		if profile, pkgSrc, err = this.InstrumentCover(pkgSrc); err != nil {
+			ErrLog.Printf("(in %s) %v\n", this.Dir, err)
+			ReportFailed()
+			return
 		}
+		// the testmain reads the counters from the package under test,
+		// even if none of the tests are in it
+		coverPkg = getTestPkg(this.Name)
 	}
 
 	for _, tpkg := range testpkgMap {
@@ -1072,6 +1163,25 @@ func (this *Package) Test() (err error) {
 		}
 		testSuite.TestPkgs = append(testSuite.TestPkgs, tpkg)
 	}
+	if testMainPkg != nil {
+		testSuite.TestMain = testMainPkg.PkgAlias
+	}
+	if coverPkg != nil {
+		testSuite.Cover = &TestCover{
+			PkgAlias: coverPkg.PkgAlias,
+			Counts:   CoverCounts,
+			Files:    profile.Files,
+		}
+	}
+
+	testsrc := path.Join(this.Dir, "_test", "_testmain.go")
+	dstDir, _ := path.Split(testsrc)
+	Exec.MkdirAll(dstDir)
+	file, err := Exec.Create(testsrc, 0644)
+
+	if err != nil {
+		return
+	}
 
 	err = TestmainTemplate.Execute(file, testSuite)
 	if err != nil {
@@ -1079,7 +1189,19 @@ func (this *Package) Test() (err error) {
 	}
 	file.Close()
 
-	err = BuildTest(this)
+	var testBinary string
+	if testBinary, err = BuildTest(this, pkgSrc, stdout, stderr); err != nil {
+		RecordTestReport(&TestReport{Target: this.Target, Err: err})
+	} else {
+		err = RunTest(this, testBinary, stdout, stderr)
+		if profile != nil && !DryRun {
+			if cerr := profile.ReadCounts(filepath.Join(this.Dir, CoverCounts)); cerr != nil {
+				WarnLog.Printf("(in %s) no coverage for \"%s\": %v\n", this.Dir, this.Target, cerr)
+			} else {
+				RecordCoverProfile(profile)
+			}
+		}
+	}
 
 	this.Stat()
 
@@ -1095,7 +1217,7 @@ func (this *Package) CleanFiles() (err error) {
 
 	if Makefiles && this.HasMakefile {
 		MakeClean(this)
-		PackagesCleaned++
+		Count(&PackagesCleaned)
 		return
 	}
 
@@ -1112,7 +1234,7 @@ func (this *Package) CleanFiles() (err error) {
 				if Verbose {
 					fmt.Printf(" Removing %s\n", this.InstallPath)
 				}
-				err = os.Remove(this.InstallPath)
+				err = Exec.Remove(this.InstallPath)
 			}
 		}
 	}
@@ -1152,21 +1274,23 @@ func (this *Package) CleanFiles() (err error) {
 	if _, err2 := os.Stat(testdir); err2 == nil {
 		test = true
 	}
+	this.RemoveFingerprint()
+
 	if !ib && !res && !test && !cgo && !proto {
 		return
 	}
 	fmt.Printf("Cleaning %s\n", this.Dir)
-	PackagesCleaned++
+	Count(&PackagesCleaned)
 	for _, obj := range this.Objects {
 		if Verbose {
 			fmt.Printf(" Removing %s\n", obj)
 		}
-		err = os.Remove(obj)
+		err = Exec.Remove(obj)
 	}
 	if Verbose {
 		fmt.Printf(" Removing %s\n", this.ResultPath)
 	}
-	err = os.Remove(this.ResultPath)
+	err = Exec.Remove(this.ResultPath)
 
 	if this.IsCmd {
 		_, bres := path.Split(this.ResultPath)
@@ -1175,13 +1299,13 @@ func (this *Package) CleanFiles() (err error) {
 			if Verbose {
 				fmt.Printf(" Removing %s\n", bres)
 			}
-			err = os.Remove(bres)
+			err = Exec.Remove(bres)
 		}
 	}
 	if Verbose {
 		fmt.Printf(" Removing %s\n", testdir)
 	}
-	err = os.RemoveAll(testdir)
+	err = Exec.RemoveAll(testdir)
 
 	if this.IsCGo {
 		err = CleanCGoPackage(this)
@@ -1192,7 +1316,7 @@ func (this *Package) CleanFiles() (err error) {
 			if Verbose {
 				fmt.Printf(" Removing %s\n", pbgo)
 			}
-			err = os.Remove(path.Join(this.Dir, pbgo))
+			err = Exec.Remove(path.Join(this.Dir, pbgo))
 		}
 	}
 
@@ -1246,7 +1370,7 @@ func (this *Package) Install() (err error) {
 
 		this.Stat()
 
-		PackagesInstalled++
+		Count(&PackagesInstalled)
 	}
 	return
 }
@@ -1352,7 +1476,7 @@ func (this *Package) GenerateMakefile() (err error) {
 				return
 			}
 		}
-		os.Remove(mpath)
+		Exec.Remove(mpath)
 	}
 
 	which := "pkg"
@@ -1361,8 +1485,8 @@ func (this *Package) GenerateMakefile() (err error) {
 	}
 	fmt.Printf("(in %s) generating makefile for %s \"%s\"\n", this.Dir, which, this.Target)
 
-	var file *os.File
-	file, err = os.Create(mpath)
+	var file io.WriteCloser
+	file, err = Exec.Create(mpath, 0644)
 
 	if err != nil {
 		return
@@ -1374,16 +1498,15 @@ func (this *Package) GenerateMakefile() (err error) {
 		Target:      this.Target,
 		GBROOT:      reverseDots,
 		GoFiles:     this.PkgSrc[this.Name],
-		CopyLocal:   reverseDots != ".",
-		BuildDirPkg: GetBuildDirPkg(),
-		BuildDirCmd: GetBuildDirCmd(),
+		BuildDirPkg: MakeBuildDirPkg,
+		BuildDirCmd: MakeBuildDirCmd,
 	}
 	for _, dep := range this.DepPkgs {
 		data.LocalDeps = append(data.LocalDeps, dep.Target)
 	}
 	for _, asm := range this.AsmSrcs {
 		base := asm[0 : len(asm)-2] // definitely ends with '.s', so this is safe
-		asmObj := base + GetObjSuffix()
+		asmObj := base + Tools.ObjSuffix()
 		data.AsmObjs = append(data.AsmObjs, asmObj)
 	}
 
@@ -1422,7 +1545,7 @@ func (this *Package) CollectGoInstall(gm map[string]bool) {
 	}
 }
 
-func (this *Package) AddToBuild(bfile *os.File) (err error) {
+func (this *Package) AddToBuild(bfile io.Writer) (err error) {
 	if this.addedToBuild {
 		return
 	}
@@ -0,0 +1,127 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Platform struct {
+	GOOS, GOARCH string
+}
+
+func (p Platform) String() string {
+	return p.GOOS + "/" + p.GOARCH
+}
+
+// the build matrix given with --platforms
+var Platforms []Platform
+
+// ParsePlatforms reads a list like "linux/amd64,linux/386".
+func ParsePlatforms(list string) (platforms []Platform, err error) {
+	for _, item := range SplitTags(list) {
+		split := strings.Index(item, "/")
+		if split <= 0 || split == len(item)-1 {
+			err = errors.New(fmt.Sprintf("platform %q is not of the form GOOS/GOARCH", item))
+			return
+		}
+		platforms = append(platforms, Platform{item[:split], item[split+1:]})
+	}
+	if len(platforms) == 0 {
+		err = errors.New("no platforms listed")
+	}
+	return
+}
+
+type PlatformResult struct {
+	Platform
+	Built     []string
+	Broken    int
+	BrokenMsg []string
+	Err       error
+}
+
+// ResetRun forgets the targets and counters of a previous RunGB.
+func ResetRun() {
+	Packages = make(map[string]*Package)
+	ListedPkgs = nil
+	ListedTargets = 0
+	ResetCounts()
+}
+
+// ResetCounts forgets what a previous RunGB built, tested and reported.
+func ResetCounts() {
+	PackagesBuilt, PackagesCleaned, PackagesInstalled, BrokenPackages = 0, 0, 0, 0
+	BuiltTargets = nil
+	BrokenMsg = nil
+	goinstalledAlready = make(map[string]bool)
+	testReports = nil
+	coverProfiles = nil
+}
+
+// RunPlatforms runs gb once for each platform in the build matrix, rescanning
+// the workspace so that file and directory filtering follows each platform,
+// and then summarizes the results.
+func RunPlatforms() (failed bool) {
+	var results []PlatformResult
+
+	for _, p := range Platforms {
+		fmt.Printf("Building for %s\n", p)
+
+		ResetRun()
+
+		result := PlatformResult{Platform: p}
+		if !SetPlatform(p.GOOS, p.GOARCH) {
+			result.Err = errors.New("unknown platform")
+		} else if err := FindExternals(); err != nil {
+			result.Err = err
+		} else {
+			MakeObjDirs()
+			result.Err = RunGB()
+		}
+		if result.Err != nil {
+			ErrLog.Printf("(for %s) %v\n", p, result.Err)
+		}
+		result.Built = BuiltTargets
+		result.Broken = BrokenPackages
+		result.BrokenMsg = BrokenMsg
+
+		results = append(results, result)
+	}
+
+	fmt.Printf("Platform summary:\n")
+	for _, result := range results {
+		status := fmt.Sprintf("built %d, broken %d", len(result.Built), result.Broken)
+		if result.Err != nil {
+			status = fmt.Sprintf("failed: %v", result.Err)
+		}
+		fmt.Printf(" %s: %s\n", result.Platform, status)
+		for _, target := range result.Built {
+			fmt.Printf("  built \"%s\"\n", target)
+		}
+		for _, msg := range result.BrokenMsg {
+			fmt.Printf("  %s\n", msg)
+		}
+		if result.Err != nil || len(result.BrokenMsg) != 0 {
+			failed = true
+		}
+	}
+
+	return
+}
@@ -29,7 +29,7 @@ func GenerateProtobufSource(this *Package) (err error) {
 		gosrc := GoForProto(pbs)
 
 		var protopkg string
-		protopkg, _, _, _, _, _, err = GetDeps(filepath.Join(this.Dir, gosrc))
+		protopkg, _, _, _, _, _, _, _, err = GetDeps(filepath.Join(this.Dir, gosrc), this.BuildTags())
 		if err != nil {
 			return
 		}
@@ -53,7 +53,7 @@ func LoadCWD() (err error) {
 				RunningInGOPATH = gp
 				if CWD != gpsrc {
 					CWD = gpsrc
-					fmt.Printf("Running gb in GOPATH workspace %s\n", CWD)
+					fmt.Fprintf(os.Stderr, "Running gb in GOPATH workspace %s\n", CWD)
 					runningInGOPATH = true
 				}
 			}
@@ -64,7 +64,7 @@ func LoadCWD() (err error) {
 		cfg := ReadConfig(".")
 		if rel, set := cfg.Workspace(); set {
 			CWD = GetAbs(filepath.Join(OSWD, rel), OSWD)
-			fmt.Printf("Running gb in workspace %s\n", CWD)
+			fmt.Fprintf(os.Stderr, "Running gb in workspace %s\n", CWD)
 		}
 	}
 	os.Chdir(CWD)
@@ -89,15 +89,8 @@ func LoadEnvs() bool {
 		os.Setenv("GOBIN", GOBIN)
 	}
 
-	if !arch_flags[GOARCH] {
-		ErrLog.Printf("Unknown GOARCH %s", GOARCH)
-		return false
-	}
-
-	if !os_flags[GOOS] {
-		ErrLog.Printf("Unknown GOOS %s", GOOS)
-		return false
-	}
+	LoadPlatforms(ReadConfig("."))
+	LoadIgnore()
 
 	GOPATH = os.Getenv("GOPATH")
 
@@ -118,15 +111,50 @@ func LoadEnvs() bool {
 			}
 
 			GOPATH_SRCROOTS = append(GOPATH_SRCROOTS, gpsrc)
-			objdst := filepath.Join(gp, "pkg", fmt.Sprintf("%s_%s", GOOS, GOARCH))
-			GOPATH_OBJDSTS = append(GOPATH_OBJDSTS, objdst)
-			GOPATH_CFLAGS = append(GOPATH_CFLAGS, "-I", objdst)
-			GOPATH_LDFLAGS = append(GOPATH_LDFLAGS, "-L", objdst)
-
-			os.MkdirAll(objdst, 0755)
 		}
 	}
 
+	RunningInGOROOT = HasPathPrefix(CWD, filepath.Join(GOROOT, "src"))
+
+	return SetPlatform(GOOS, GOARCH)
+}
+
+// MakeObjDirs creates the GOPATH object directories for the current platform,
+// which the compile and link flags point at. It waits until the flags are
+// known, so that -n can stop it.
+func MakeObjDirs() {
+	for _, objdst := range GOPATH_OBJDSTS {
+		Exec.MkdirAll(objdst)
+	}
+}
+
+// SetPlatform selects the GOOS and GOARCH to build for, and recomputes the
+// GOPATH object directories and compile/link flags that depend on them.
+func SetPlatform(goos, goarch string) bool {
+	if !arch_flags[goarch] {
+		ErrLog.Printf("Unknown GOARCH %s", goarch)
+		return false
+	}
+
+	if !os_flags[goos] {
+		ErrLog.Printf("Unknown GOOS %s", goos)
+		return false
+	}
+
+	GOOS, GOARCH = goos, goarch
+	os.Setenv("GOOS", GOOS)
+	os.Setenv("GOARCH", GOARCH)
+
+	GOPATH_OBJDSTS, GOPATH_CFLAGS, GOPATH_LDFLAGS = nil, nil, nil
+	for _, gp := range GOPATHS {
+		objdst := filepath.Join(gp, "pkg", fmt.Sprintf("%s_%s", GOOS, GOARCH))
+		GOPATH_OBJDSTS = append(GOPATH_OBJDSTS, objdst)
+		GOPATH_CFLAGS = append(GOPATH_CFLAGS, "-I", objdst)
+		GOPATH_LDFLAGS = append(GOPATH_LDFLAGS, "-L", objdst)
+	}
+
+	GCFLAGS, GLDFLAGS = nil, nil
+
 	gcFlagsStr, gldFlagsStr := os.Getenv("GCFLAGS"), os.Getenv("GB_GLDFLAGS")
 	if gcFlagsStr != "" {
 		GCFLAGS = append(GCFLAGS, strings.Fields(gcFlagsStr)...)
@@ -138,13 +166,13 @@ func LoadEnvs() bool {
 	GCFLAGS = append(GCFLAGS, GOPATH_CFLAGS...)
 	GLDFLAGS = append(GLDFLAGS, GOPATH_LDFLAGS...)
 
-	RunningInGOROOT = HasPathPrefix(CWD, filepath.Join(GOROOT, "src"))
-
 	return true
 }
 
+// results are kept apart for each platform, so that changing $GOARCH never
+// links against archives built for another one
 func GetBuildDirPkg() (dir string) {
-	return ObjDir
+	return filepath.Join(ObjDir, GOOS+"_"+GOARCH)
 }
 
 func GetGOROOTDirPkg() (dir string) {
@@ -159,7 +187,7 @@ func GetInstallDirPkg() (dir string) {
 }
 
 func GetBuildDirCmd() (dir string) {
-	return BinDir
+	return filepath.Join(BinDir, GOOS+"_"+GOARCH)
 }
 
 func GetInstallDirCmd() (dir string) {
@@ -169,39 +197,6 @@ func GetInstallDirCmd() (dir string) {
 	return GOBIN
 }
 
-func ArchChar() (c string) {
-	switch GOARCH {
-	case "amd64":
-		return "6"
-	case "386":
-		return "8"
-	case "arm":
-		return "5"
-	}
-	panic("unknown arch " + GOARCH)
-	return
-}
-
-func GetCompilerName() (name string) {
-	return ArchChar() + "g"
-}
-
-func GetCCompilerName() (name string) {
-	return ArchChar() + "c"
-}
-
-func GetAssemblerName() (name string) {
-	return ArchChar() + "a"
-}
-
-func GetLinkerName() (name string) {
-	return ArchChar() + "l"
-}
-
-func GetObjSuffix() (suffix string) {
-	return "." + ArchChar()
-}
-
 func GetIBName() (name string) {
-	return fmt.Sprintf("_go_%s", GetObjSuffix())
+	return "_go_" + Tools.ObjSuffix()
 }
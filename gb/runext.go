@@ -18,10 +18,14 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 var MakeCMD,
@@ -36,6 +40,7 @@ var MakeCMD,
 	GoFixCMD,
 	CGoCMD,
 	GCCCMD,
+	PkgConfigCMD,
 	ProtocCMD string
 
 func FindGobinExternal(name string) (path string, err error) {
@@ -49,56 +54,33 @@ func FindGobinExternal(name string) (path string, err error) {
 
 func FindExternals() (err error) {
 
-	CompileCMD, err = FindGobinExternal(GetCompilerName())
-	if err != nil {
-		fmt.Printf("Could not find '%s' in path\n", GetCompilerName())
-		return
-	}
-	AsmCMD, err = FindGobinExternal(GetAssemblerName())
-	if err != nil {
-		fmt.Printf("Could not find '%s' in path\n", GetAssemblerName())
-		return
-	}
-	LinkCMD, err = FindGobinExternal(GetLinkerName())
-	if err != nil {
-		fmt.Printf("Could not find '%s' in path\n", GetLinkerName())
-		return
-	}
-	PackCMD, err = FindGobinExternal("gopack")
-	if err != nil {
-		fmt.Printf("Could not find 'gopack' in path\n")
+	if err = Tools.FindTools(); err != nil {
+		ErrLog.Printf("%v\n", err)
 		return
 	}
 
 	var err2 error
-	CGoCMD, err2 = FindGobinExternal("cgo")
-	if err2 != nil {
-		fmt.Printf("Could not find 'cgo' in path\n")
-	}
 	MakeCMD, err2 = FindGobinExternal("gomake")
 	if err2 != nil {
-		fmt.Printf("Could not find 'gomake' in path\n")
+		WarnLog.Printf("Could not find 'gomake' in path\n")
 	}
 	GoInstallCMD, err2 = FindGobinExternal("goinstall")
 	if err2 != nil {
-		fmt.Printf("Could not find 'goinstall' in path\n")
+		WarnLog.Printf("Could not find 'goinstall' in path\n")
 	}
 	GoFMTCMD, err2 = FindGobinExternal("gofmt")
 	if err2 != nil {
-		fmt.Printf("Could not find 'gofmt' in path\n")
+		WarnLog.Printf("Could not find 'gofmt' in path\n")
 	}
 	GoFixCMD, err2 = FindGobinExternal("gofix")
 	if err2 != nil {
-		fmt.Printf("Could not find 'gofix' in path\n")
+		WarnLog.Printf("Could not find 'gofix' in path\n")
 	}
 	GCCCMD, err2 = exec.LookPath("gcc")
 	if err2 != nil {
 		//fmt.Printf("Could not find 'gcc' in path\n")
 	}
-	CCMD, err2 = FindGobinExternal(GetCCompilerName())
-	if err2 != nil {
-		fmt.Printf("Could not find '%' in path\n", GetCCompilerName())
-	}
+	PkgConfigCMD, _ = exec.LookPath("pkg-config")
 	ProtocCMD, err2 = exec.LookPath("protoc")
 	if err2 != nil {
 		//fmt.Printf("Could not find 'protoc' in path\n")
@@ -109,37 +91,147 @@ func FindExternals() (err error) {
 	return
 }
 
+// SplitArgs splits arguments that hold several words, like the flags of a
+// #cgo line or of gcflags=, with SplitQuoted. Arguments that hold one word are
+// left alone.
 func SplitArgs(args []string) (sargs []string) {
 	for _, arg := range args {
-		sarg := strings.Fields(arg)
+		if !strings.ContainsAny(arg, " \t\n\"'") {
+			if arg != "" {
+				sargs = append(sargs, arg)
+			}
+			continue
+		}
+		sarg, err := SplitQuoted(arg)
+		if err != nil {
+			sarg = strings.Fields(arg)
+		}
 		sargs = append(sargs, sarg...)
 	}
 	return
 }
 
-func RunExternalDump(cmd, wd string, argv []string, dump *os.File) (err error) {
-	argv = SplitArgs(argv)
+// SplitQuoted splits text into words at spaces, like a shell: a word may
+// contain spaces inside "double" or 'single' quotes, which are removed, and a
+// backslash keeps the quote, backslash or space that follows it from being
+// special.
+func SplitQuoted(text string) (words []string, err error) {
+	return SplitQuotedExpand(text, nil)
+}
 
-	if Verbose {
-		fmt.Printf("%s\n", argv)
+// SplitQuotedExpand splits text like SplitQuoted, handing the text from each
+// $ outside single quotes to expand, which gives what to put in its place and
+// how many bytes of the text that replaces. The value becomes part of the
+// word the $ is in, spaces and all. A $ that expand uses none of is kept.
+func SplitQuotedExpand(text string, expand func(text string) (value string, n int, err error)) (words []string, err error) {
+	var word []rune
+	inWord := false
+	var quote rune
+	// a backslash only escapes what would otherwise be special there, and
+	// nothing between single quotes
+	escapes := func(next rune) bool {
+		switch quote {
+		case '\'':
+			return false
+		case '"':
+			return next == '"' || next == '\\'
+		}
+		return strings.ContainsRune("\"'\\ \t", next)
+	}
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\\' && i+1 < len(runes) && escapes(runes[i+1]):
+			i++
+			word = append(word, runes[i])
+			inWord = true
+		case r == '$' && expand != nil && quote != '\'':
+			rest := string(runes[i:])
+			value, n, xerr := expand(rest)
+			if xerr != nil {
+				err = xerr
+				return
+			}
+			if n == 0 {
+				word = append(word, r)
+				inWord = true
+				continue
+			}
+			// like a shell, an empty value outside quotes makes no word
+			word = append(word, []rune(value)...)
+			inWord = inWord || value != ""
+			i += utf8.RuneCountInString(rest[:n]) - 1
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word = append(word, r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				words = append(words, string(word))
+				word = nil
+				inWord = false
+			}
+		default:
+			word = append(word, r)
+			inWord = true
+		}
 	}
+	if quote != 0 {
+		err = errors.New(fmt.Sprintf("unclosed %c quote", quote))
+		return
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return
+}
+
+func RunExternalDump(cmd, wd string, argv []string, dump io.Writer) (err error) {
+	return RunExternalTo(cmd, wd, argv, dump, os.Stderr)
+}
+
+// RunExternalTo runs cmd with its stdout and stderr going to the given
+// writers.
+func RunExternalTo(cmd, wd string, argv []string, stdout, stderr io.Writer) (err error) {
+	_, err = RunExternalTimeout(cmd, wd, argv, stdout, stderr, 0)
+	return
+}
 
-	c := exec.Command(cmd, argv[1:]...)
-	c.Dir = wd
-	c.Env = os.Environ()
+// RunExternalTimeout runs cmd like RunExternalTo, but kills it if it is still
+// running after timeout. A timeout of zero waits forever.
+func RunExternalTimeout(cmd, wd string, argv []string, stdout, stderr io.Writer, timeout time.Duration) (killed bool, err error) {
+	return Exec.Run(cmd, wd, SplitArgs(argv), stdout, stderr, timeout)
+}
 
-	c.Stdout = dump
-	c.Stderr = os.Stderr
+// QueryExternal runs cmd like RunExternalTo, even with -n. It is for commands
+// that only report on the system, like pkg-config, whose answers decide what
+// gb would do.
+func QueryExternal(cmd, wd string, argv []string, stdout, stderr io.Writer) (err error) {
+	_, err = RealExecutor{}.Run(cmd, wd, SplitArgs(argv), stdout, stderr, 0)
+	return
+}
 
-	err = c.Run()
+// RunExternalOutput runs cmd like QueryExternal, and returns what it writes
+// to stdout.
+func RunExternalOutput(cmd, wd string, argv []string) (output []byte, err error) {
+	var dump *os.File
+	dump, err = ioutil.TempFile("", "gb")
+	if err != nil {
+		return
+	}
+	defer os.Remove(dump.Name())
+	defer dump.Close()
 
-	if wmsg, ok := err.(*exec.ExitError); ok {
-		if wmsg.ExitStatus() != 0 {
-			err = errors.New(fmt.Sprintf("%v: %s\n", argv, wmsg.String()))
-		} else {
-			err = nil
-		}
+	if err = QueryExternal(cmd, wd, argv, dump, os.Stderr); err != nil {
+		return
 	}
+	output, err = ioutil.ReadFile(dump.Name())
 	return
 }
 func RunExternal(cmd, wd string, argv []string) (err error) {
@@ -0,0 +1,111 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ScanInfo is what --json prints for each target found by a scan.
+type ScanInfo struct {
+	Target, Dir, Name string
+
+	IsCmd, IsCGo, IsProtobuf bool
+
+	Deps, TestDeps        []string
+	DepPkgs, TestDepPkgs  []string
+	GoSources, CGoSources []string
+	AsmSrcs, TestSources  []string
+	DeadSources           []string
+
+	ResultPath, InstallPath string
+
+	NeedsBuild, NeedsInstall bool
+}
+
+// UnquoteDep turns an import as stored in Deps, such as "\"fmt\"" or
+// "\"cgo\"-cmd", into plain text.
+func UnquoteDep(dep string) string {
+	if i := strings.LastIndex(dep, "\""); i > 0 && dep[0] == '"' {
+		return dep[1:i] + dep[i+1:]
+	}
+	return dep
+}
+
+func sortedDeps(deps []string) (list []string) {
+	list = []string{}
+	for _, dep := range deps {
+		list = append(list, UnquoteDep(dep))
+	}
+	sort.Strings(list)
+	return
+}
+
+func sortedTargets(pkgs []*Package) (list []string) {
+	list = []string{}
+	for _, pkg := range pkgs {
+		list = append(list, pkg.Target)
+	}
+	sort.Strings(list)
+	return
+}
+
+func sortedFiles(files []string) (list []string) {
+	list = append([]string{}, files...)
+	sort.Strings(list)
+	return
+}
+
+func (this *Package) ScanInfo() (info ScanInfo) {
+	info = ScanInfo{
+		Target:       this.Target,
+		Dir:          this.Dir,
+		Name:         this.Name,
+		IsCmd:        this.IsCmd,
+		IsCGo:        this.IsCGo,
+		IsProtobuf:   this.IsProtobuf,
+		Deps:         sortedDeps(this.Deps),
+		TestDeps:     sortedDeps(this.TestDeps),
+		DepPkgs:      sortedTargets(this.DepPkgs),
+		TestDepPkgs:  sortedTargets(this.TestDepPkgs),
+		GoSources:    sortedFiles(this.GoSources),
+		CGoSources:   sortedFiles(this.CGoSources),
+		AsmSrcs:      sortedFiles(this.AsmSrcs),
+		TestSources:  sortedFiles(this.TestSources),
+		DeadSources:  sortedFiles(this.DeadSources),
+		ResultPath:   this.ResultPath,
+		InstallPath:  this.InstallPath,
+		NeedsBuild:   this.NeedsBuild,
+		NeedsInstall: this.NeedsInstall,
+	}
+	return
+}
+
+// PrintScanJSON prints the target as a single line of JSON.
+func (this *Package) PrintScanJSON() (err error) {
+	var data []byte
+	data, err = json.Marshal(this.ScanInfo())
+	if err != nil {
+		ErrLog.Printf("(in %s) %v", this.Dir, err)
+		return
+	}
+	fmt.Printf("%s\n", data)
+	return
+}
@@ -0,0 +1,211 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync"
+)
+
+// guards the build counters, BrokenMsg and ReturnFailCode, which concurrent
+// builds and tests share
+var countLock sync.Mutex
+
+func Count(counter *int) {
+	countLock.Lock()
+	*counter++
+	countLock.Unlock()
+}
+
+func ReportBuilt(target string) {
+	countLock.Lock()
+	PackagesBuilt++
+	BuiltTargets = append(BuiltTargets, target)
+	countLock.Unlock()
+}
+
+func ReportBroken(msg string) {
+	countLock.Lock()
+	BrokenMsg = append(BrokenMsg, msg)
+	countLock.Unlock()
+}
+
+func ReportFailed() {
+	countLock.Lock()
+	ReturnFailCode = true
+	countLock.Unlock()
+}
+
+type byTarget []*Package
+
+func (p byTarget) Len() int      { return len(p) }
+func (p byTarget) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byTarget) Less(i, j int) bool {
+	if p[i].Target != p[j].Target {
+		return p[i].Target < p[j].Target
+	}
+	return p[i].Dir < p[j].Dir
+}
+
+// BuildConcurrently brings pkgs and everything they depend on up to date,
+// building at most jobs targets at once. A target is started as soon as all
+// of its dependencies have finished, and a failure only stops the targets
+// that depend on the broken one. The commands the targets run are limited to
+// Jobs at once on their own, by RealExecutor.
+func BuildConcurrently(pkgs []*Package, jobs int) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	waiting := make(map[*Package]int)
+	dependents := make(map[*Package][]*Package)
+	var all []*Package
+
+	var collect func(pkg *Package)
+	collect = func(pkg *Package) {
+		if _, ok := waiting[pkg]; ok {
+			return
+		}
+		waiting[pkg] = len(pkg.DepPkgs)
+		all = append(all, pkg)
+		for _, dep := range pkg.DepPkgs {
+			collect(dep)
+			dependents[dep] = append(dependents[dep], pkg)
+		}
+	}
+	for _, pkg := range pkgs {
+		collect(pkg)
+	}
+
+	// start targets in a fixed order so that runs are repeatable
+	sort.Sort(byTarget(all))
+	rank := make(map[*Package]int)
+	for i, pkg := range all {
+		rank[pkg] = i
+	}
+
+	var ready []*Package
+	for _, pkg := range all {
+		if waiting[pkg] == 0 {
+			ready = append(ready, pkg)
+		}
+	}
+
+	firstMsg, firstBuilt := len(BrokenMsg), len(BuiltTargets)
+
+	done := make(chan *Package)
+	running := 0
+	for len(ready) != 0 || running != 0 {
+		for len(ready) != 0 && running < jobs {
+			pkg := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				pkg.build(false)
+				done <- pkg
+			}()
+		}
+
+		pkg := <-done
+		running--
+		for _, dpkg := range dependents[pkg] {
+			waiting[dpkg]--
+			if waiting[dpkg] == 0 {
+				ready = append(ready, dpkg)
+			}
+		}
+		sort.Sort(byRank{ready, rank})
+	}
+
+	// these arrive in completion order
+	sort.Strings(BrokenMsg[firstMsg:])
+	sort.Strings(BuiltTargets[firstBuilt:])
+}
+
+type byRank struct {
+	pkgs []*Package
+	rank map[*Package]int
+}
+
+func (p byRank) Len() int           { return len(p.pkgs) }
+func (p byRank) Swap(i, j int)      { p.pkgs[i], p.pkgs[j] = p.pkgs[j], p.pkgs[i] }
+func (p byRank) Less(i, j int) bool { return p.rank[p.pkgs[i]] < p.rank[p.pkgs[j]] }
+
+// TestConcurrently tests pkgs, running at most jobs test binaries at once,
+// after building everything the tests import. Each package's output is held
+// back until its tests are done so that packages don't interleave. Packages
+// that live in the same directory share its _test directory, so they are
+// tested one after the other.
+func TestConcurrently(pkgs []*Package, jobs int) (err error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var deps []*Package
+	for _, pkg := range pkgs {
+		deps = append(deps, pkg.TestDepPkgs...)
+	}
+	BuildConcurrently(deps, jobs)
+
+	var dirs []string
+	byDir := make(map[string][]*Package)
+	for _, pkg := range pkgs {
+		if err = pkg.PrepareTest(); err != nil {
+			return
+		}
+		if _, ok := byDir[pkg.Dir]; !ok {
+			dirs = append(dirs, pkg.Dir)
+		}
+		byDir[pkg.Dir] = append(byDir[pkg.Dir], pkg)
+	}
+
+	errs := make([]error, len(dirs))
+	var outputLock sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan bool, jobs)
+	for i, dir := range dirs {
+		wg.Add(1)
+		slots <- true
+		go func(i int, group []*Package) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			for _, pkg := range group {
+				var output bytes.Buffer
+				terr := pkg.TestTo(&output, &output)
+				outputLock.Lock()
+				os.Stdout.Write(output.Bytes())
+				outputLock.Unlock()
+				if terr != nil && errs[i] == nil {
+					errs[i] = terr
+				}
+			}
+		}(i, byDir[dir])
+	}
+	wg.Wait()
+
+	for _, terr := range errs {
+		if terr != nil {
+			err = terr
+			return
+		}
+	}
+	return
+}
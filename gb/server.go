@@ -0,0 +1,369 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// the unix socket given with --serve
+var ServeSocket string
+
+// ServerRequest is one line of JSON sent to a gb server.
+type ServerRequest struct {
+	// targets, target, deps, rdeps, build, test, diagnostics or changed
+	Op string
+	// the target for deps, rdeps, build and test
+	Target string
+	// the source file for target and diagnostics, either absolute or
+	// relative to the workspace
+	File string
+	// the files that changed, for changed
+	Files []string
+	// with deps and rdeps, also follow the imports of the imports
+	All bool
+}
+
+// Diagnostic is a message about a line of a source file.
+type Diagnostic struct {
+	File         string
+	Line, Column int
+	Message      string
+}
+
+// ServerResponse is the line of JSON a gb server answers a request with.
+type ServerResponse struct {
+	Error string `json:",omitempty"`
+
+	Targets []ScanInfo `json:",omitempty"`
+
+	Failed bool     `json:",omitempty"`
+	Built  []string `json:",omitempty"`
+	Broken []string `json:",omitempty"`
+	Output string   `json:",omitempty"`
+
+	Diagnostics []Diagnostic `json:",omitempty"`
+}
+
+// Server answers requests about the workspace from the targets it keeps
+// scanned. Requests are handled one at a time.
+type Server struct {
+	lock     sync.Mutex
+	snapshot map[string]dirState
+}
+
+// Serve scans the workspace and answers requests on a unix socket until gb
+// is interrupted.
+func Serve(socket string) (err error) {
+	if conn, derr := net.Dial("unix", socket); derr == nil {
+		conn.Close()
+		err = errors.New(fmt.Sprintf("a gb server is already listening on %s", socket))
+		return
+	}
+	// a server that went away without cleaning up leaves its socket behind
+	os.Remove(socket)
+
+	this := &Server{snapshot: WatchSnapshot()}
+	if err = ScanWorkspace(); err != nil {
+		return
+	}
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return
+	}
+	defer os.Remove(socket)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		listener.Close()
+	}()
+
+	fmt.Printf("Serving %d targets on %s\n", len(Packages), socket)
+	for {
+		conn, aerr := listener.Accept()
+		if aerr != nil {
+			// closed by an interrupt
+			return
+		}
+		go this.ServeConn(conn)
+	}
+}
+
+// ServeConn answers the requests sent over conn, one line of JSON each.
+func (this *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var req ServerRequest
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF {
+				enc.Encode(ServerResponse{Error: err.Error()})
+			}
+			return
+		}
+		if err := enc.Encode(this.Handle(req)); err != nil {
+			return
+		}
+	}
+}
+
+// Handle answers one request, first catching up with any source that
+// changed since the last one.
+func (this *Server) Handle(req ServerRequest) (resp ServerResponse) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	var err error
+	resp.Output = captureOutput(func() {
+		ResetCounts()
+
+		var notified []string
+		for _, file := range req.Files {
+			notified = append(notified, GetRelative(CWD, filepath.Dir(GetAbs(file, CWD)), CWD))
+		}
+		var affected []*Package
+		if affected, err = this.refresh(notified); err != nil {
+			return
+		}
+
+		switch req.Op {
+		case "targets":
+			resp.Targets = scanInfos(ListedPkgs)
+		case "target":
+			var pkg *Package
+			if pkg, err = PackageForFile(req.File); err == nil {
+				resp.Targets = scanInfos([]*Package{pkg})
+			}
+		case "deps", "rdeps":
+			var pkg *Package
+			if pkg, err = PackageForTarget(req.Target); err == nil {
+				resp.Targets = scanInfos(RelatedPackages(pkg, req.Op == "rdeps", req.All))
+			}
+		case "build":
+			var pkg *Package
+			if pkg, err = PackageForTarget(req.Target); err == nil {
+				resp.Failed = serverBuild(pkg) != nil
+			}
+		case "test":
+			var pkg *Package
+			if pkg, err = PackageForTarget(req.Target); err == nil {
+				if len(pkg.TestSources) == 0 {
+					err = errors.New(fmt.Sprintf("(in %s) no tests for \"%s\"", pkg.Dir, pkg.Target))
+				} else {
+					resp.Failed = serverBuild(pkg) != nil || pkg.Test() != nil
+				}
+			}
+		case "diagnostics":
+			var pkg *Package
+			if pkg, err = PackageForFile(req.File); err == nil {
+				resp.Failed = serverBuild(pkg) != nil
+			}
+		case "changed":
+			resp.Targets = scanInfos(affected)
+		default:
+			err = errors.New(fmt.Sprintf("unknown op %q", req.Op))
+		}
+		resp.Built = BuiltTargets
+		resp.Broken = BrokenMsg
+	})
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if req.Op == "diagnostics" && err == nil {
+		resp.Diagnostics = FindDiagnostics(resp.Output, req.File)
+	}
+	switch req.Op {
+	case "build", "test", "diagnostics":
+	default:
+		resp.Output = ""
+	}
+	return
+}
+
+// rescan the directories that changed since the last request, and the ones
+// with notified files
+func (this *Server) refresh(notified []string) (affected []*Package, err error) {
+	after := WatchSnapshot()
+	changed, structural := ChangedDirs(this.snapshot, after)
+	this.snapshot = after
+	changed = RemoveDups(append(changed, notified...))
+	if len(changed) == 0 {
+		return
+	}
+	affected, _, err = Refresh(changed, structural)
+	return
+}
+
+func scanInfos(pkgs []*Package) (infos []ScanInfo) {
+	infos = []ScanInfo{}
+	for _, pkg := range pkgs {
+		infos = append(infos, pkg.ScanInfo())
+	}
+	return
+}
+
+// build pkg, and what it imports, if they aren't up to date
+func serverBuild(pkg *Package) (err error) {
+	for _, p := range Packages {
+		p.resetBuild()
+	}
+	for _, p := range Packages {
+		p.CheckStatus()
+	}
+	if err = pkg.Build(); err == nil && pkg.FailedToBuild {
+		err = errors.New("Cannot build deps")
+	}
+	return
+}
+
+// PackageForTarget finds a target by name. A package is preferred to a
+// command with the same name.
+func PackageForTarget(target string) (pkg *Package, err error) {
+	if pkg = Packages["\""+target+"\""]; pkg != nil {
+		return
+	}
+	if pkg = Packages["\""+target+"\"-cmd"]; pkg != nil {
+		return
+	}
+	err = errors.New(fmt.Sprintf("no target %q", target))
+	return
+}
+
+// PackageForFile finds the target whose directory holds file.
+func PackageForFile(file string) (pkg *Package, err error) {
+	dir := GetRelative(CWD, filepath.Dir(GetAbs(file, CWD)), CWD)
+	for _, p := range Packages {
+		if p.Dir == dir {
+			pkg = p
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("no target in %s", dir))
+	return
+}
+
+// RelatedPackages lists the targets pkg imports or, with reverse, the ones
+// that import it. With all, their imports (or importers) are followed too.
+func RelatedPackages(pkg *Package, reverse, all bool) (related []*Package) {
+	direct := func(p *Package) (list []*Package) {
+		if !reverse {
+			return p.DepPkgs
+		}
+		for _, other := range Packages {
+			for _, dep := range other.DepPkgs {
+				if dep == p {
+					list = append(list, other)
+					break
+				}
+			}
+		}
+		return
+	}
+
+	seen := map[*Package]bool{pkg: true}
+	next := []*Package{pkg}
+	for len(next) != 0 {
+		var found []*Package
+		for _, p := range next {
+			for _, rel := range direct(p) {
+				if !seen[rel] {
+					seen[rel] = true
+					related = append(related, rel)
+					found = append(found, rel)
+				}
+			}
+		}
+		if !all {
+			break
+		}
+		next = found
+	}
+	sort.Sort(byTarget(related))
+	return
+}
+
+// a compiler message, possibly labeled by gb, such as "m.go:6:17: undefined: x"
+var diagnosticLine = regexp.MustCompile(`^(?:gb (?:error|warning): )?(?:\(in [^)]*\) )?([^\s:][^:]*\.(?:go|c|h|s|proto)):([0-9]+)(?::([0-9]+))?: (.*)$`)
+
+// FindDiagnostics picks the messages about file out of build output. Tools
+// name files relative to either the workspace or the target's directory.
+func FindDiagnostics(output, file string) (diags []Diagnostic) {
+	diags = []Diagnostic{}
+	abs := GetAbs(file, CWD)
+	dir := filepath.Dir(abs)
+	for _, line := range bytes.Split([]byte(output), []byte("\n")) {
+		m := diagnosticLine.FindStringSubmatch(string(bytes.TrimSpace(line)))
+		if m == nil {
+			continue
+		}
+		if GetAbs(m[1], dir) != abs && GetAbs(m[1], CWD) != abs {
+			continue
+		}
+		diag := Diagnostic{File: abs, Message: m[4]}
+		diag.Line, _ = strconv.Atoi(m[2])
+		diag.Column, _ = strconv.Atoi(m[3])
+		diags = append(diags, diag)
+	}
+	return
+}
+
+// captureOutput runs f with everything gb, and the tools it runs, print
+// going to the returned text instead.
+func captureOutput(f func()) (output string) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		f()
+		return
+	}
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		r.Close()
+		done <- buf.String()
+	}()
+
+	stdout, stderr, errLog, warnLog := os.Stdout, os.Stderr, ErrLog, WarnLog
+	os.Stdout, os.Stderr = w, w
+	ErrLog = log.New(w, "gb error: ", 0)
+	WarnLog = log.New(w, "gb warning: ", 0)
+
+	f()
+
+	os.Stdout, os.Stderr, ErrLog, WarnLog = stdout, stderr, errLog, warnLog
+	w.Close()
+	output = <-done
+	return
+}
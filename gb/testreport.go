@@ -0,0 +1,328 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the report asked for with --test-report, and where to write it
+var TestReportFormat, TestReportPath string
+
+// ParseTestReport reads a --test-report value like "junit:path".
+func ParseTestReport(value string) (format, path string, err error) {
+	split := strings.Index(value, ":")
+	if split != -1 {
+		format, path = value[:split], value[split+1:]
+	}
+	if format != "junit" && format != "tap" || path == "" {
+		err = errors.New(fmt.Sprintf("test report %q is not of the form junit:<path> or tap:<path>", value))
+	}
+	return
+}
+
+type TestCaseReport struct {
+	Name   string
+	Status string // PASS, FAIL or SKIP
+	Time   float64
+	Output string
+}
+
+// A TestReport holds the results of one package's test binary.
+type TestReport struct {
+	Target string
+	Time   float64
+	Cases  []TestCaseReport
+	Output string
+	// why the tests could not be built, or the binary failed without any
+	// test failing
+	Err error
+}
+
+func (this *TestReport) Count(status string) (n int) {
+	for _, tc := range this.Cases {
+		if tc.Status == status {
+			n++
+		}
+	}
+	return
+}
+
+var testReports []*TestReport
+var testReportsLock sync.Mutex
+
+func RecordTestReport(report *TestReport) {
+	if TestReportFormat == "" {
+		return
+	}
+	testReportsLock.Lock()
+	testReports = append(testReports, report)
+	testReportsLock.Unlock()
+}
+
+type byReportTarget []*TestReport
+
+func (p byReportTarget) Len() int           { return len(p) }
+func (p byReportTarget) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byReportTarget) Less(i, j int) bool { return p[i].Target < p[j].Target }
+
+// a "-test.v" result line, as in "--- PASS: TestFoo (0.01s)", or
+// "(0.01 seconds)" from older testing packages
+var testResultLine = regexp.MustCompile(`^--- (PASS|FAIL|SKIP): (\S+) \(([0-9.]+) ?(s|seconds)\)`)
+
+// HasTestVerbose tells if the test binary will already be run with -test.v.
+func HasTestVerbose(args []string) bool {
+	for _, arg := range args {
+		if arg == "-test.v" || arg == "-test.v=true" {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTestOutput finds the result of each test in the "-test.v" output of a
+// test binary. The lines a test logs are kept with its result, whether they
+// come before it, as in current testing packages, or after it, as in older
+// ones. If the binary died in the middle of a test, that test is failed with
+// whatever it printed.
+func ParseTestOutput(target, output string, elapsed time.Duration, runErr error) (report *TestReport) {
+	report = &TestReport{
+		Target: target,
+		Time:   elapsed.Seconds(),
+		Output: output,
+	}
+
+	// lines logged by each test before its result, and the tests that were
+	// started but never finished
+	logs := make(map[string][]string)
+	var started []string
+	finished := make(map[string]bool)
+	current := ""
+	last := -1
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if m := testResultLine.FindStringSubmatch(trimmed); m != nil {
+			seconds, _ := strconv.ParseFloat(m[3], 64)
+			report.Cases = append(report.Cases, TestCaseReport{
+				Name:   m[2],
+				Status: m[1],
+				Time:   seconds,
+				Output: strings.Join(logs[m[2]], "\n"),
+			})
+			last = len(report.Cases) - 1
+			finished[m[2]] = true
+			continue
+		}
+		if strings.HasPrefix(trimmed, "=== ") {
+			// === RUN, === CONT, === PAUSE or === NAME, followed by the test
+			if fields := strings.Fields(trimmed); len(fields) == 3 {
+				if fields[1] == "RUN" {
+					started = append(started, fields[2])
+				}
+				current = fields[2]
+			}
+			last = -1
+			continue
+		}
+		if trimmed == "PASS" || trimmed == "FAIL" || trimmed == "" {
+			continue
+		}
+		if last != -1 {
+			tc := &report.Cases[last]
+			if tc.Output != "" {
+				tc.Output += "\n"
+			}
+			tc.Output += trimmed
+		} else {
+			logs[current] = append(logs[current], trimmed)
+		}
+	}
+
+	if runErr != nil {
+		for _, name := range started {
+			if !finished[name] {
+				report.Cases = append(report.Cases, TestCaseReport{
+					Name:   name,
+					Status: "FAIL",
+					Output: strings.Join(logs[name], "\n"),
+				})
+			}
+		}
+	}
+	if runErr != nil && report.Count("FAIL") == 0 {
+		report.Err = runErr
+	}
+	return
+}
+
+// WriteTestReport writes the results recorded during the run to
+// TestReportPath, with packages ordered by target.
+func WriteTestReport() (err error) {
+	if TestReportFormat == "" {
+		return
+	}
+
+	testReportsLock.Lock()
+	reports := testReports
+	testReportsLock.Unlock()
+	sort.Sort(byReportTarget(reports))
+
+	var fout io.WriteCloser
+	fout, err = Exec.Create(TestReportPath, 0644)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+
+	switch TestReportFormat {
+	case "junit":
+		err = WriteJUnit(fout, reports)
+	case "tap":
+		err = WriteTAP(fout, reports)
+	}
+	if err == nil {
+		fmt.Printf("Wrote %s test report to %s\n", TestReportFormat, TestReportPath)
+	}
+	return
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitCase struct {
+	XMLName   xml.Name      `xml:"testcase"`
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	Skipped   *junitFailure `xml:"skipped,omitempty"`
+}
+
+type junitSuite struct {
+	XMLName   xml.Name    `xml:"testsuite"`
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Errors    int         `xml:"errors,attr"`
+	Skipped   int         `xml:"skipped,attr"`
+	Time      string      `xml:"time,attr"`
+	Cases     []junitCase `xml:"testcase"`
+	SystemOut string      `xml:"system-out,omitempty"`
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+func WriteJUnit(fout io.Writer, reports []*TestReport) (err error) {
+	var suites junitSuites
+	for _, report := range reports {
+		suite := junitSuite{
+			Name:      report.Target,
+			Failures:  report.Count("FAIL"),
+			Skipped:   report.Count("SKIP"),
+			Time:      fmt.Sprintf("%.3f", report.Time),
+			SystemOut: report.Output,
+		}
+		for _, tc := range report.Cases {
+			jc := junitCase{
+				ClassName: report.Target,
+				Name:      tc.Name,
+				Time:      fmt.Sprintf("%.3f", tc.Time),
+			}
+			switch tc.Status {
+			case "FAIL":
+				jc.Failure = &junitFailure{"Failed", tc.Output}
+			case "SKIP":
+				jc.Skipped = &junitFailure{"Skipped", tc.Output}
+			}
+			suite.Cases = append(suite.Cases, jc)
+		}
+		if report.Err != nil {
+			suite.Errors = 1
+			suite.Cases = append(suite.Cases, junitCase{
+				ClassName: report.Target,
+				Name:      report.Target,
+				Time:      suite.Time,
+				Error:     &junitFailure{report.Err.Error(), report.Output},
+			})
+		}
+		suite.Tests = len(suite.Cases)
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	var data []byte
+	if data, err = xml.Marshal(suites); err != nil {
+		return
+	}
+	fmt.Fprintf(fout, "%s%s\n", xml.Header, data)
+	return
+}
+
+func WriteTAP(fout io.Writer, reports []*TestReport) (err error) {
+	total := 0
+	for _, report := range reports {
+		total += len(report.Cases)
+		if report.Err != nil {
+			total++
+		}
+	}
+
+	fmt.Fprintf(fout, "TAP version 13\n1..%d\n", total)
+	n := 0
+	diagnose := func(output string) {
+		if output == "" {
+			return
+		}
+		for _, line := range strings.Split(output, "\n") {
+			fmt.Fprintf(fout, "# %s\n", line)
+		}
+	}
+	for _, report := range reports {
+		for _, tc := range report.Cases {
+			n++
+			switch tc.Status {
+			case "PASS":
+				fmt.Fprintf(fout, "ok %d - %s %s # time=%.3fs\n", n, report.Target, tc.Name, tc.Time)
+			case "SKIP":
+				fmt.Fprintf(fout, "ok %d - %s %s # SKIP\n", n, report.Target, tc.Name)
+			default:
+				fmt.Fprintf(fout, "not ok %d - %s %s # time=%.3fs\n", n, report.Target, tc.Name, tc.Time)
+				diagnose(tc.Output)
+			}
+		}
+		if report.Err != nil {
+			n++
+			fmt.Fprintf(fout, "not ok %d - %s\n", n, report.Target)
+			diagnose(report.Err.Error())
+		}
+	}
+	return
+}
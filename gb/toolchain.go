@@ -0,0 +1,649 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A CompileJob describes one run of the Go compiler. All paths are relative
+// to the directory the compiler runs in.
+type CompileJob struct {
+	ImportPath string   // the path the result will be imported as, or "main"
+	Srcs       []string // the .go files
+	AsmSrcs    []string // .s files that will be assembled into the same package
+	Obj        string   // where to write the result
+	Includes   []string // directories holding archives the sources may import, in order of preference
+	Flags      []string // extra compiler flags, such as from gb.cfg
+}
+
+// A Toolchain runs the steps that turn a target's source into archives and
+// binaries. Every method runs its commands in the working directory wd, with
+// their output going to stdout and stderr, and all other paths are relative
+// to it.
+type Toolchain interface {
+	// the name used to select the toolchain with --toolchain
+	Name() string
+	// FindTools locates the commands this toolchain runs for the current
+	// $GOARCH, and fills in CompileCMD, AsmCMD, LinkCMD, PackCMD, CGoCMD
+	// and CCMD.
+	FindTools() error
+	// the suffix of the object files written by Compile and Assemble
+	ObjSuffix() string
+	// files, besides objects, that Compile and Assemble leave behind
+	Intermediates() []string
+	// ArchiveName is where the archive for a package is kept, relative to
+	// a directory of archives such as _obj/$GOOS_$GOARCH.
+	ArchiveName(target string) string
+	// GOROOTArchive finds the archive the toolchain links for a package of
+	// the standard library, on the current platform.
+	GOROOTArchive(importPath string) (archive string, found bool)
+
+	Compile(pkg *Package, wd string, job CompileJob, stdout, stderr io.Writer) error
+	Assemble(pkg *Package, wd, importPath, src, obj string, stdout, stderr io.Writer) error
+	// Pack creates archive from objs. The first object is the one written
+	// by Compile.
+	Pack(pkg *Package, wd, archive string, objs []string, stdout, stderr io.Writer) error
+	// Link links objs into binary. The first object is the one Compile
+	// wrote for package main, and the rest are assembled or made by cgo for
+	// it. ldflags are the #cgo LDFLAGS of the C code in the binary, which
+	// the toolchain hands to the system linker.
+	Link(pkg *Package, wd, binary string, objs, includes, ldflags []string, stdout, stderr io.Writer) error
+
+	// Cgo runs cgo on srcs, which are in the package importPath, with the
+	// #cgo CFLAGS of the package. It writes its output to wd/_obj.
+	Cgo(pkg *Package, wd, importPath string, srcs, cflags []string, stdout, stderr io.Writer) error
+	// CgoImports finishes the cgo step for the package name once the C code
+	// has been linked into dynobj, returning Go files to compile with the
+	// package and objects to pack with it.
+	CgoImports(pkg *Package, wd, name, dynobj string, stdout, stderr io.Writer) (gofiles, objs []string, err error)
+}
+
+// the toolchain selected at startup
+var Tools Toolchain
+
+// where the 6g and go toolchains pack the objects of a command that has more
+// than one, since their linkers take a single one
+const mainArchiveName = "_go_.main.a"
+
+// the toolchain asked for with --toolchain, if any
+var ToolchainName string
+
+var Toolchains = []Toolchain{&GCToolchain{}, &GoToolchain{}, &GccgoToolchain{}}
+
+// SelectToolchain picks the toolchain named with --toolchain or in the
+// workspace's gb.cfg or, if none was named, the first one whose tools can be
+// found.
+func SelectToolchain() (err error) {
+	name := ToolchainName
+	if name == "" {
+		name, _ = ReadConfig(".").Toolchain()
+	}
+	if name != "" {
+		for _, tc := range Toolchains {
+			if tc.Name() == name {
+				Tools = tc
+				return
+			}
+		}
+		err = errors.New(fmt.Sprintf("unknown toolchain '%s'", name))
+		return
+	}
+
+	var msgs []string
+	for _, tc := range Toolchains {
+		if err = tc.FindTools(); err == nil {
+			Tools = tc
+			return
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %v", tc.Name(), err))
+	}
+	err = errors.New(fmt.Sprintf("no usable toolchain (%s)", strings.Join(msgs, "; ")))
+	return
+}
+
+func FindTool(name string) (path string, err error) {
+	path, err = FindGobinExternal(name)
+	if err != nil {
+		path = ""
+		err = errors.New(fmt.Sprintf("Could not find '%s' in path", name))
+	}
+	return
+}
+
+// FindArchives lists the archives found under includes, which are absolute
+// or relative to wd, by their slash-separated path below the include directory. An
+// archive hides any with the same path in a later directory.
+func FindArchives(wd string, includes []string) (rels []string, archives map[string]string) {
+	archives = make(map[string]string)
+	for _, inc := range includes {
+		root := inc
+		if !filepath.IsAbs(root) {
+			root = GetAbs(filepath.Join(wd, inc), CWD)
+		}
+		filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || !strings.HasSuffix(p, ".a") {
+				return nil
+			}
+			rel := filepath.ToSlash(p[len(root)+1:])
+			if _, ok := archives[rel]; !ok {
+				archives[rel] = p
+				rels = append(rels, rel)
+			}
+			return nil
+		})
+	}
+	return
+}
+
+// GCToolchain is the 6g/8g/5g family, with gopack, cgo and 6c.
+type GCToolchain struct{}
+
+func (this *GCToolchain) ArchChar() (c string) {
+	switch GOARCH {
+	case "amd64":
+		return "6"
+	case "386":
+		return "8"
+	case "arm":
+		return "5"
+	}
+	return
+}
+
+func (this *GCToolchain) Name() string {
+	return "6g"
+}
+
+func (this *GCToolchain) FindTools() (err error) {
+	char := this.ArchChar()
+	if char == "" {
+		err = errors.New(fmt.Sprintf("no compiler for GOARCH %s", GOARCH))
+		return
+	}
+
+	if CompileCMD, err = FindTool(char + "g"); err != nil {
+		return
+	}
+	if AsmCMD, err = FindTool(char + "a"); err != nil {
+		return
+	}
+	if LinkCMD, err = FindTool(char + "l"); err != nil {
+		return
+	}
+	if PackCMD, err = FindTool("gopack"); err != nil {
+		return
+	}
+
+	// cgo targets complain about these when they are missing
+	CGoCMD, _ = FindTool("cgo")
+	CCMD, _ = FindTool(char + "c")
+	return
+}
+
+func (this *GCToolchain) ObjSuffix() string {
+	return "." + this.ArchChar()
+}
+
+func (this *GCToolchain) Intermediates() []string {
+	return []string{mainArchiveName}
+}
+
+func (this *GCToolchain) ArchiveName(target string) string {
+	return target + ".a"
+}
+
+func (this *GCToolchain) GOROOTArchive(importPath string) (archive string, found bool) {
+	archive = filepath.Join(GetGOROOTDirPkg(), this.ArchiveName(importPath))
+	_, err := os.Stat(archive)
+	found = err == nil
+	return
+}
+
+func (this *GCToolchain) Compile(pkg *Package, wd string, job CompileJob, stdout, stderr io.Writer) (err error) {
+	argv := []string{this.ArchChar() + "g"}
+	for _, inc := range job.Includes {
+		argv = append(argv, "-I", inc)
+	}
+	argv = append(argv, GCFLAGS...)
+	argv = append(argv, "-o", job.Obj)
+	argv = append(argv, job.Flags...)
+	argv = append(argv, job.Srcs...)
+
+	err = RunExternalTo(CompileCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GCToolchain) Assemble(pkg *Package, wd, importPath, src, obj string, stdout, stderr io.Writer) (err error) {
+	// 6a names the object after the source on its own
+	argv := []string{this.ArchChar() + "a", src}
+	err = RunExternalTo(AsmCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GCToolchain) Pack(pkg *Package, wd, archive string, objs []string, stdout, stderr io.Writer) (err error) {
+	argv := []string{"gopack", "grc", archive}
+	argv = append(argv, objs...)
+	err = RunExternalTo(PackCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GCToolchain) Link(pkg *Package, wd, binary string, objs, includes, ldflags []string, stdout, stderr io.Writer) (err error) {
+	obj := objs[0]
+	if len(objs) > 1 {
+		if err = this.Pack(pkg, wd, mainArchiveName, objs, stdout, stderr); err != nil {
+			return
+		}
+		obj = mainArchiveName
+	}
+
+	// 6l can't use the system linker, so ldflags are left to the imports
+	// cgo found in the C code
+	argv := []string{this.ArchChar() + "l"}
+	argv = append(argv, GLDFLAGS...)
+	for _, inc := range includes {
+		argv = append(argv, "-L", inc)
+	}
+	argv = append(argv, "-o", binary, obj)
+	err = RunExternalTo(LinkCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GCToolchain) Cgo(pkg *Package, wd, importPath string, srcs, cflags []string, stdout, stderr io.Writer) (err error) {
+	//CGOPKGPATH= cgo --  e1.go e2.go
+	argv := []string{"cgo", "--", "-I" + GetRelative(wd, pkg.Dir, CWD)}
+	argv = append(argv, cflags...)
+	argv = append(argv, srcs...)
+	err = RunExternalTo(CGoCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GCToolchain) CgoImports(pkg *Package, wd, name, dynobj string, stdout, stderr io.Writer) (gofiles, objs []string, err error) {
+	//6c -FVw -I/Users/jasmuth/Documents/userland/go/pkg/darwin_amd64 _cgo_defun.c
+	cdefargv := []string{this.ArchChar() + "c", "-FVw", "-I" + GetGOROOTDirPkg()}
+	for _, objdst := range GOPATH_OBJDSTS {
+		cdefargv = append(cdefargv, "-I"+objdst)
+	}
+	cdefargv = append(cdefargv, filepath.Join("_obj", "_cgo_defun.c"))
+	if err = RunExternalTo(CCMD, wd, cdefargv, stdout, stderr); err != nil {
+		return
+	}
+
+	//cgo -dynimport _cgo1_.o >__cgo_import.c && mv -f __cgo_import.c _cgo_import.c
+	if Verbose {
+		fmt.Fprintf(stdout, "writing to %s\n", "__cgo_import.c")
+	}
+	var dump io.WriteCloser
+	dump, err = Exec.Create(filepath.Join(wd, "__cgo_import.c"), 0644)
+	if err != nil {
+		return
+	}
+	err = RunExternalTo(CGoCMD, wd, []string{"cgo", "-dynimport", dynobj}, dump, stderr)
+	dump.Close()
+	if err != nil {
+		return
+	}
+	if Verbose {
+		fmt.Fprintf(stdout, "Moving __cgo_import.c to _cgo_import.c\n")
+	}
+	err = Exec.Rename(filepath.Join(wd, "__cgo_import.c"), filepath.Join(wd, "_cgo_import.c"))
+	if err != nil {
+		return
+	}
+
+	//6c -FVw _cgo_import.c
+	ccargv := []string{this.ArchChar() + "c", "-FVw", "_cgo_import.c"}
+	if err = RunExternalTo(CCMD, wd, ccargv, stdout, stderr); err != nil {
+		return
+	}
+
+	objs = []string{"_cgo_defun" + this.ObjSuffix(), "_cgo_import" + this.ObjSuffix()}
+	return
+}
+
+// GoToolchain drives a current Go installation through "go tool". Since
+// such an installation keeps the standard library's archives in the build
+// cache, imports are resolved with an import config file that maps each
+// path to the archive "go list -export" reports for it.
+type GoToolchain struct {
+	exportLock sync.Mutex
+	// archive for each import path, by $GOOS_$GOARCH, "" if go list has none
+	exports map[string]map[string]string
+	// the import paths go list said are in the standard library
+	standard map[string]bool
+	// the imports of the sources of each object Compile wrote, by its path
+	objImports map[string][]string
+}
+
+const (
+	importCfgName = "_go_.importcfg"
+	symabisName   = "_go_.symabis"
+	asmHdrName    = "go_asm.h"
+	linkArgsName  = "_go_.linkargs"
+)
+
+func (this *GoToolchain) Name() string {
+	return "go"
+}
+
+func (this *GoToolchain) FindTools() (err error) {
+	var gocmd string
+	if gocmd, err = FindTool("go"); err != nil {
+		return
+	}
+	CompileCMD, AsmCMD, LinkCMD, PackCMD, CGoCMD = gocmd, gocmd, gocmd, gocmd, gocmd
+	CCMD = ""
+	return
+}
+
+func (this *GoToolchain) ObjSuffix() string {
+	return ".o"
+}
+
+func (this *GoToolchain) Intermediates() []string {
+	return []string{importCfgName, symabisName, asmHdrName, mainArchiveName, linkArgsName}
+}
+
+func (this *GoToolchain) ArchiveName(target string) string {
+	return target + ".a"
+}
+
+// the standard library isn't installed as archives in GOROOT, but go list
+// reports where the build cache keeps them
+func (this *GoToolchain) GOROOTArchive(importPath string) (archive string, found bool) {
+	// ask about every import in the workspace at once, rather than running
+	// go list for each
+	imports := []string{importPath}
+	for _, pkg := range Packages {
+		for _, dep := range append(pkg.Deps, pkg.TestDeps...) {
+			if _, ok := Packages[dep]; ok {
+				continue
+			}
+			if depPath, err := strconv.Unquote(dep); err == nil && depPath != "C" {
+				imports = append(imports, depPath)
+			}
+		}
+	}
+	exports, err := this.Exports(RemoveDups(imports))
+	if err != nil {
+		return
+	}
+	this.exportLock.Lock()
+	standard := this.standard[importPath]
+	this.exportLock.Unlock()
+	archive = exports[importPath]
+	found = standard && archive != ""
+	return
+}
+
+// the flags that let assembly see the runtime's headers and the package's
+// go_asm.h
+func (this *GoToolchain) asmFlags(importPath string) []string {
+	return []string{"-p", importPath,
+		"-I", ".", "-I", filepath.Join(GOROOT, "pkg", "include"),
+		"-D", "GOOS_" + GOOS, "-D", "GOARCH_" + GOARCH}
+}
+
+func (this *GoToolchain) Compile(pkg *Package, wd string, job CompileJob, stdout, stderr io.Writer) (err error) {
+	var imports []string
+	for _, src := range job.Srcs {
+		deps, err2 := GetImports(filepath.Join(wd, src))
+		if err2 != nil && DryRun {
+			// made by a step that was only printed, such as cgo
+			continue
+		}
+		if err2 != nil {
+			err = err2
+			return
+		}
+		imports = append(imports, deps...)
+	}
+	this.exportLock.Lock()
+	if this.objImports == nil {
+		this.objImports = make(map[string][]string)
+	}
+	this.objImports[filepath.Join(wd, job.Obj)] = imports
+	this.exportLock.Unlock()
+	if err = this.WriteImportCfg(wd, job.Includes, imports); err != nil {
+		return
+	}
+
+	argv := []string{"go", "tool", "compile", "-p", job.ImportPath, "-importcfg", importCfgName, "-pack"}
+
+	if len(job.AsmSrcs) != 0 {
+		sargv := []string{"go", "tool", "asm", "-gensymabis", "-o", symabisName}
+		sargv = append(sargv, this.asmFlags(job.ImportPath)...)
+		sargv = append(sargv, job.AsmSrcs...)
+		if err = RunExternalTo(AsmCMD, wd, sargv, stdout, stderr); err != nil {
+			return
+		}
+		argv = append(argv, "-symabis", symabisName, "-asmhdr", asmHdrName)
+	}
+
+	argv = append(argv, GCFLAGS...)
+	argv = append(argv, "-o", job.Obj)
+	argv = append(argv, job.Flags...)
+	argv = append(argv, job.Srcs...)
+
+	err = RunExternalTo(CompileCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GoToolchain) Assemble(pkg *Package, wd, importPath, src, obj string, stdout, stderr io.Writer) (err error) {
+	argv := []string{"go", "tool", "asm"}
+	argv = append(argv, this.asmFlags(importPath)...)
+	argv = append(argv, "-o", obj, src)
+	err = RunExternalTo(AsmCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GoToolchain) Pack(pkg *Package, wd, archive string, objs []string, stdout, stderr io.Writer) (err error) {
+	// the compiler already wrote an archive, which "c" copies into the new one
+	argv := []string{"go", "tool", "pack", "c", archive}
+	argv = append(argv, objs...)
+	Exec.Remove(filepath.Join(wd, archive))
+	err = RunExternalTo(PackCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GoToolchain) Link(pkg *Package, wd, binary string, objs, includes, ldflags []string, stdout, stderr io.Writer) (err error) {
+	this.exportLock.Lock()
+	direct, ok := this.objImports[filepath.Join(wd, objs[0])]
+	this.exportLock.Unlock()
+	if !ok {
+		direct = pkg.Deps
+	}
+
+	obj := objs[0]
+	if len(objs) > 1 {
+		if err = this.Pack(pkg, wd, mainArchiveName, objs, stdout, stderr); err != nil {
+			return
+		}
+		obj = mainArchiveName
+	}
+
+	// the linker needs every package in the binary
+	imports := append([]string{"runtime"}, LinkImports(pkg, direct)...)
+	if err = this.WriteImportCfg(wd, includes, imports); err != nil {
+		return
+	}
+
+	argv := []string{"go", "tool", "link", "-importcfg", importCfgName}
+	if len(ldflags) != 0 {
+		// the flags have to reach the system linker as one argument, but
+		// RunExternalTo splits arguments at spaces, so they go through a
+		// response file
+		args := fmt.Sprintf("-linkmode=external\n-extld=%s\n-extldflags=%s\n", GCCCMD, strings.Join(ldflags, " "))
+		if err = WriteFile(filepath.Join(wd, linkArgsName), []byte(args), 0644); err != nil {
+			return
+		}
+		argv = append(argv, "@"+linkArgsName)
+	}
+	argv = append(argv, GLDFLAGS...)
+	argv = append(argv, "-o", binary, obj)
+	err = RunExternalTo(LinkCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GoToolchain) Cgo(pkg *Package, wd, importPath string, srcs, cflags []string, stdout, stderr io.Writer) (err error) {
+	argv := []string{"go", "tool", "cgo", "-objdir", "_obj", "-importpath", importPath, "--", "-I" + GetRelative(wd, pkg.Dir, CWD)}
+	argv = append(argv, cflags...)
+	argv = append(argv, srcs...)
+	err = RunExternalTo(CGoCMD, wd, argv, stdout, stderr)
+	return
+}
+
+func (this *GoToolchain) CgoImports(pkg *Package, wd, name, dynobj string, stdout, stderr io.Writer) (gofiles, objs []string, err error) {
+	gofile := filepath.Join("_obj", "_cgo_import.go")
+	argv := []string{"go", "tool", "cgo", "-dynpackage", name, "-dynimport", dynobj, "-dynout", gofile}
+	if err = RunExternalTo(CGoCMD, wd, argv, stdout, stderr); err != nil {
+		return
+	}
+	gofiles = []string{gofile}
+	return
+}
+
+// LinkImports gives the import paths a binary for pkg needs, when its main
+// package imports direct: those, and the imports of each workspace target
+// among them, however indirectly. In a test binary, pkg and its test packages
+// bring in the imports of its tests as well. Whatever isn't an import path,
+// like "C" or gb's "-cmd" entries, is left out.
+func LinkImports(pkg *Package, direct []string) (imports []string) {
+	seen := make(map[string]bool)
+	var visit func(deps []string)
+	visit = func(deps []string) {
+		for _, dep := range deps {
+			importPath, err := strconv.Unquote(dep)
+			if err != nil || importPath == "C" || seen[importPath] {
+				continue
+			}
+			seen[importPath] = true
+			imports = append(imports, importPath)
+
+			_, isTest := pkg.TestSrc[importPath]
+			if importPath == pkg.Target || (isTest && importPath != pkg.Name) {
+				visit(pkg.Deps)
+				visit(pkg.TestDeps)
+			} else if p := Packages[dep]; p != nil {
+				visit(p.Deps)
+			}
+		}
+	}
+	visit(direct)
+	return
+}
+
+// WriteImportCfg writes the import config for a compile or link in wd. The
+// archives found under includes come first, and every other import is
+// looked up with go list, along with everything it depends on.
+func (this *GoToolchain) WriteImportCfg(wd string, includes, imports []string) (err error) {
+	local := make(map[string]string)
+	var order []string
+	rels, archives := FindArchives(wd, includes)
+	for _, rel := range rels {
+		importPath := rel[:len(rel)-len(".a")]
+		local[importPath] = archives[rel]
+		order = append(order, importPath)
+	}
+
+	var missing []string
+	for _, dep := range imports {
+		dep = strings.Trim(dep, "\"")
+		if _, ok := local[dep]; ok || dep == "C" || dep == "unsafe" {
+			continue
+		}
+		missing = append(missing, dep)
+	}
+	var exports map[string]string
+	if exports, err = this.Exports(RemoveDups(missing)); err != nil {
+		return
+	}
+
+	var fout io.WriteCloser
+	fout, err = Exec.Create(filepath.Join(wd, importCfgName), 0644)
+	if err != nil {
+		return
+	}
+	defer fout.Close()
+	for _, importPath := range order {
+		fmt.Fprintf(fout, "packagefile %s=%s\n", importPath, local[importPath])
+	}
+	for importPath, archive := range exports {
+		if _, ok := local[importPath]; ok || archive == "" {
+			continue
+		}
+		fmt.Fprintf(fout, "packagefile %s=%s\n", importPath, archive)
+	}
+	return
+}
+
+// Exports makes sure go list has reported on imports for the current
+// platform, and returns a copy of all it has reported so far.
+func (this *GoToolchain) Exports(imports []string) (exports map[string]string, err error) {
+	this.exportLock.Lock()
+	defer this.exportLock.Unlock()
+
+	if this.exports == nil {
+		this.exports = make(map[string]map[string]string)
+	}
+	platform := GOOS + "_" + GOARCH
+	known := this.exports[platform]
+	if known == nil {
+		known = make(map[string]string)
+		this.exports[platform] = known
+	}
+
+	var unknown []string
+	for _, importPath := range imports {
+		if _, ok := known[importPath]; !ok {
+			unknown = append(unknown, importPath)
+		}
+	}
+	if len(unknown) != 0 {
+		argv := []string{"go", "list", "-e", "-export", "-deps", "-f={{.ImportPath}}={{.Standard}}={{.Export}}"}
+		argv = append(argv, unknown...)
+		var output []byte
+		if output, err = RunExternalOutput(CompileCMD, CWD, argv); err != nil {
+			return
+		}
+		for _, importPath := range unknown {
+			known[importPath] = ""
+		}
+		if this.standard == nil {
+			this.standard = make(map[string]bool)
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if fields := strings.SplitN(line, "=", 3); len(fields) == 3 {
+				known[fields[0]] = fields[2]
+				this.standard[fields[0]] = fields[1] == "true"
+			}
+		}
+	}
+
+	exports = make(map[string]string)
+	for importPath, archive := range known {
+		exports[importPath] = archive
+	}
+	return
+}
@@ -32,8 +32,12 @@ Options:
  -G use "goinstall -clean -u" when possible
  -h print this usage text
  -i install
+ -j <n> run at most n compilers, linkers and other tools at once; implies
+    -p (default is the number of CPUs)
  -L scan and list targets and their source files
  -m use makefiles, when possible
+ -n print the commands that would run, and the files that would be written
+    or removed, without doing any of it
  -N nuke
  -p build packages in parallel, when possible
  -P build/clean/install only packages
@@ -48,8 +52,37 @@ Options:
      generate standard makefiles without building
  --workspace
      create workspace.gb files in all directories
+ --graph
+     print the dependency graph of the listed targets in Graphviz DOT format
+ --graph-depth=<n>
+     with --graph, only follow imports n levels deep
+ --config
+     print each target's gb.cfg settings, and where each one came from
+ --why <dir-or-target>
+     explain why a target would be rebuilt or installed
+ --json
+     with -s, -S or -L, print each target as a line of JSON
+ --platforms <os1/arch1,os2/arch2...>
+     build once for each listed platform
+ --toolchain <name>
+     build with "6g" (6g, 8g or 5g and gopack), "go" (go tool compile,
+     link, asm and pack) or "gccgo" instead of the first one found
+ --tags <tag1,tag2...>
+     also build files whose +build lines require these tags
  --make-a-mess
      don't clean up intermediate files
+ --cover
+     with -t, write statement coverage profiles and print a summary
+ --cover-html <path>
+     same as --cover, and write the annotated sources to an HTML file
+ --test-report <junit|tap>:<path>
+     with -t, write the results of every test to a JUnit XML or TAP file
+ --test-timeout <duration>
+     with -t, kill test binaries that run for longer than this
+ --watch[=<interval>]
+     keep rebuilding (and with -t, retesting) targets as their source changes
+ --serve <socket>
+     answer JSON requests from editors on a unix socket, keeping the scan
  --testargs
      all arguments following --testargs are passed to the test binary
 `
@@ -0,0 +1,311 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how often --watch looks at the workspace
+var WatchInterval = time.Second
+
+// the files in a directory that can change what gb does there
+func isWatchedFile(dir, name string) bool {
+	if dir == "." && name == IgnoreFile {
+		return true
+	}
+	if strings.HasPrefix(name, ".") || WorkspaceIgnore.Match(filepath.Join(dir, name), false) {
+		return false
+	}
+	switch name {
+	case "gb.cfg", "target.gb", "Makefile", "makefile":
+		return true
+	}
+	if strings.HasSuffix(name, ".pb.go") {
+		// generated from a .proto by the build itself
+		proto := name[:len(name)-len(".pb.go")] + ".proto"
+		if _, err := os.Stat(filepath.Join(dir, proto)); err == nil {
+			return false
+		}
+	}
+	switch filepath.Ext(name) {
+	case ".go", ".c", ".h", ".s", ".proto":
+		return true
+	}
+	return false
+}
+
+// a directory's watched files, with their sizes and modification times
+type dirState map[string]string
+
+// WatchSnapshot records the watched files of every directory gb would scan.
+func WatchSnapshot() (dirs map[string]dirState) {
+	dirs = make(map[string]dirState)
+	var walk func(dir string)
+	walk = func(dir string) {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		state := make(dirState)
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() {
+				if !IgnoredDir(filepath.Join(dir, name)) {
+					walk(filepath.Join(dir, name))
+				}
+				continue
+			}
+			if isWatchedFile(dir, name) {
+				state[name] = fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+			}
+		}
+		dirs[dir] = state
+	}
+	walk(".")
+	return
+}
+
+// ChangedDirs lists the directories whose watched files differ between two
+// snapshots. It also says whether directories came or went.
+func ChangedDirs(before, after map[string]dirState) (changed []string, structural bool) {
+	for dir, state := range after {
+		old, ok := before[dir]
+		if !ok {
+			structural = true
+			changed = append(changed, dir)
+			continue
+		}
+		same := len(old) == len(state)
+		for name, stamp := range state {
+			if old[name] != stamp {
+				same = false
+				break
+			}
+		}
+		if !same {
+			changed = append(changed, dir)
+		}
+	}
+	for dir := range before {
+		if _, ok := after[dir]; !ok {
+			structural = true
+			changed = append(changed, dir)
+		}
+	}
+	if before["."][IgnoreFile] != after["."][IgnoreFile] {
+		// what is ignored changed, so targets can appear or vanish anywhere
+		structural = true
+	}
+	sort.Strings(changed)
+	return
+}
+
+// forget what the last cycle did with the target, so that it is looked at
+// again
+func (this *Package) resetBuild() {
+	this.built = false
+	this.rebuilt = false
+	this.FailedToBuild = false
+	this.NeedsBuild = false
+	this.fingerprint = nil
+	this.Stat()
+}
+
+// RescanDirs scans the targets in dirs again, replacing them in Packages and
+// ListedPkgs, and returns the targets that are affected: the rescanned ones
+// and everything that imports them. If the changes can't be handled by
+// rescanning only those directories, because a target appeared, vanished or
+// changed its name, rescan is set and the whole workspace must be scanned.
+func RescanDirs(dirs []string) (affected []*Package, rescan bool) {
+	touched := make(map[*Package]bool)
+	replaced := make(map[*Package]*Package)
+	for _, dir := range dirs {
+		found := false
+		for key, old := range Packages {
+			if old.Dir != dir {
+				continue
+			}
+			found = true
+			cfg, sources := EffectiveConfig(dir)
+			if !cfg.Equal(old.Cfg) {
+				// a changed gb.cfg can change the targets of the directories
+				// below, which only a full scan notices
+				rescan = true
+				return
+			}
+			pkg, err := NewPackage(old.scanBase, old.Dir, old.InTestData, old.Parent, cfg)
+			if err != nil || pkg.packagesKey() != key {
+				rescan = true
+				return
+			}
+			pkg.CfgSources = sources
+			Packages[key] = pkg
+			replaced[old] = pkg
+			touched[pkg] = true
+		}
+		if !found {
+			// maybe there is a new target
+			rescan = true
+			return
+		}
+	}
+
+	for _, pkg := range Packages {
+		if replaced[pkg.Parent] != nil {
+			pkg.Parent = replaced[pkg.Parent]
+		}
+	}
+	for i, pkg := range ListedPkgs {
+		if replaced[pkg] != nil {
+			ListedPkgs[i] = replaced[pkg]
+		}
+	}
+
+	for _, pkg := range Packages {
+		pkg.DepPkgs = nil
+		pkg.TestDepPkgs = nil
+		pkg.ResolveDeps()
+	}
+	for _, pkg := range Packages {
+		if pkg.DetectCycles() != nil {
+			rescan = true
+			return
+		}
+	}
+
+	// whatever imports an affected target is affected too
+	for grew := true; grew; {
+		grew = false
+		for _, pkg := range Packages {
+			if touched[pkg] {
+				continue
+			}
+			deps := pkg.DepPkgs
+			if Test {
+				deps = append(append([]*Package{}, deps...), pkg.TestDepPkgs...)
+			}
+			for _, dep := range deps {
+				if touched[dep] {
+					touched[pkg] = true
+					grew = true
+					break
+				}
+			}
+		}
+	}
+
+	for pkg := range touched {
+		affected = append(affected, pkg)
+	}
+	sort.Sort(byTarget(affected))
+	return
+}
+
+// Refresh brings the scanned targets up to date with the directories in
+// changed, scanning only those again when it can, and the whole workspace
+// when it must. It returns the targets affected by the changes, which are all
+// of them if the workspace was rescanned.
+func Refresh(changed []string, structural bool) (affected []*Package, rescanned bool, err error) {
+	rescanned = structural
+	if !rescanned {
+		affected, rescanned = RescanDirs(changed)
+	}
+	if rescanned {
+		affected = nil
+		LoadIgnore()
+		ResetRun()
+		if err = ScanWorkspace(); err != nil {
+			return
+		}
+		for _, pkg := range Packages {
+			affected = append(affected, pkg)
+		}
+		sort.Sort(byTarget(affected))
+	}
+	return
+}
+
+// WatchCycle brings the targets up to date after the directories in changed
+// were modified, and prints a one line status.
+func WatchCycle(changed []string, structural bool) {
+	start := time.Now()
+
+	ResetCounts()
+
+	affected, rescanned, err := Refresh(changed, structural)
+	var pkgs []*Package
+	if err == nil {
+		listed := make(map[*Package]bool)
+		for _, pkg := range ListedPkgs {
+			listed[pkg] = true
+		}
+		for _, pkg := range affected {
+			pkg.resetBuild()
+			if listed[pkg] {
+				pkgs = append(pkgs, pkg)
+			}
+		}
+		for _, pkg := range Packages {
+			pkg.CheckStatus()
+		}
+		TryBuild(pkgs)
+		err = TryTest(pkgs)
+	}
+	for _, msg := range BrokenMsg {
+		fmt.Printf("%s\n", msg)
+	}
+	if err != nil {
+		ErrLog.Printf("%v\n", err)
+	}
+
+	what := fmt.Sprintf("%d affected", len(pkgs))
+	if rescanned {
+		what = "rescanned, " + what
+	}
+	status := fmt.Sprintf("%d built, %d broken", PackagesBuilt, BrokenPackages)
+	if Test && err != nil {
+		status += ", tests failed"
+	} else if Test {
+		status += ", tests passed"
+	}
+	fmt.Printf("[%s] %s changed, %s: %s (%.1fs)\n", time.Now().Format("15:04:05"),
+		strings.Join(changed, " "), what, status, time.Since(start).Seconds())
+}
+
+// WatchWorkspace polls the workspace for changed source, rebuilding (and with -t,
+// retesting) the targets affected by each change. It does not return.
+func WatchWorkspace() {
+	fmt.Printf("Watching for changes, every %v\n", WatchInterval)
+	before := WatchSnapshot()
+	for {
+		time.Sleep(WatchInterval)
+		after := WatchSnapshot()
+		changed, structural := ChangedDirs(before, after)
+		if len(changed) == 0 {
+			continue
+		}
+		WatchCycle(changed, structural)
+		before = after
+	}
+}
@@ -0,0 +1,251 @@
+/*
+   Copyright 2011 John Asmuth
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the directory or target given with --why
+var WhyTarget string
+
+// PackageForName finds a target by its name or, failing that, by its
+// directory, which is relative to where gb was run.
+func PackageForName(name string) (pkg *Package, err error) {
+	if pkg, err = PackageForTarget(name); err == nil {
+		return
+	}
+	dir := GetRelative(CWD, GetAbs(name, OSWD), CWD)
+	for _, p := range Packages {
+		if p.Dir == dir {
+			pkg, err = p, nil
+			return
+		}
+	}
+	err = errors.New(fmt.Sprintf("no target or target directory %q", name))
+	return
+}
+
+func TryWhy() (err error) {
+	if WhyTarget == "" {
+		return
+	}
+	var pkg *Package
+	if pkg, err = PackageForName(WhyTarget); err != nil {
+		return
+	}
+	pkg.PrintWhy()
+	return
+}
+
+// PrintWhy prints why the target would be rebuilt, or that it is up to date,
+// and why it would be installed with -i.
+func (this *Package) PrintWhy() {
+	label := "pkg"
+	if this.IsCmd {
+		label = "cmd"
+	}
+	fmt.Printf("%s \"%s\" in %s", label, this.Target, this.Dir)
+
+	reasons := this.WhyBuild()
+	if len(reasons) == 0 {
+		fmt.Printf(" is up to date\n")
+	} else {
+		fmt.Printf(" would be rebuilt:\n")
+		for _, reason := range reasons {
+			fmt.Printf(" %s\n", reason)
+		}
+	}
+
+	if install := this.WhyInstall(len(reasons) != 0); install != "" {
+		fmt.Printf(" with -i, it would be installed: %s\n", install)
+	}
+}
+
+// WhyBuild lists the reasons the target would be rebuilt, following the
+// decision made by Touched and Stale, and is empty if it is up to date. A
+// dependency that would be rebuilt is followed by its own reasons, indented,
+// so that the chain leads back to what set it off.
+func (this *Package) WhyBuild() (reasons []string) {
+	return this.whyBuild(make(map[*Package]bool))
+}
+
+func (this *Package) whyBuild(explained map[*Package]bool) (reasons []string) {
+	if this.NeedsGoInstall {
+		reasons = append(reasons, "goinstall needed for a missing import")
+	}
+	if GoInstallUpdate {
+		for _, dep := range this.Deps {
+			if _, ok := Packages[dep]; !ok && IsGoInstallable(dep) {
+				reasons = append(reasons, "goinstall update requested")
+				break
+			}
+		}
+	}
+
+	for _, pkg := range this.DepPkgs {
+		if explained[pkg] {
+			reasons = append(reasons, fmt.Sprintf("dependency \"%s\" would be rebuilt (see above)", pkg.Target))
+			continue
+		}
+		depReasons := pkg.whyBuild(explained)
+		if len(depReasons) == 0 {
+			continue
+		}
+		explained[pkg] = true
+		reasons = append(reasons, fmt.Sprintf("dependency \"%s\" would be rebuilt:", pkg.Target))
+		for _, reason := range depReasons {
+			reasons = append(reasons, " "+reason)
+		}
+	}
+
+	reasons = append(reasons, this.whyStale()...)
+	return
+}
+
+// the reasons Stale would give
+func (this *Package) whyStale() (reasons []string) {
+	result := GetRelative(CWD, this.ResultPath, CWD)
+	if this.BinTime == 0 {
+		reasons = append(reasons, fmt.Sprintf("never built: %s does not exist", result))
+		return
+	}
+
+	stored, err := ReadFingerprint(this.FingerprintPath())
+	if err != nil {
+		// no fingerprint, so modification times decide
+		for _, src := range this.ArchiveSources() {
+			if t, _ := StatTime(filepath.Join(this.Dir, src)); t > this.BinTime {
+				reasons = append(reasons, fmt.Sprintf("source %s newer than %s", src, result))
+			}
+		}
+		for _, pkg := range this.DepPkgs {
+			if pkg.BinTime > this.BinTime {
+				reasons = append(reasons, fmt.Sprintf("dependency \"%s\" rebuilt", pkg.Target))
+			}
+		}
+		if this.GOROOTPkgTime > this.BinTime {
+			for _, dep := range this.Deps {
+				if _, ok := Packages[dep]; ok {
+					continue
+				}
+				if exists, t := PkgExistsInGOROOT(dep); exists && t > this.BinTime {
+					reasons = append(reasons, fmt.Sprintf("GOROOT package %s newer than %s", Tools.ArchiveName(strings.Trim(dep, "\"")), result))
+				}
+			}
+		}
+		return
+	}
+
+	current := this.Fingerprint()
+	keys := make(map[string]bool)
+	for key := range stored {
+		keys[key] = true
+	}
+	for key := range current {
+		keys[key] = true
+	}
+	var sorted []string
+	for key := range keys {
+		if stored[key] != current[key] {
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+	for _, key := range sorted {
+		reasons = append(reasons, FingerprintChange(key, stored, current))
+	}
+	return
+}
+
+// FingerprintChange describes how the input key differs between the
+// fingerprint of the last build and the current one.
+func FingerprintChange(key string, before, after Fingerprint) string {
+	old, hadOld := before[key]
+	cur, hasCur := after[key]
+	split := strings.Index(key, ":")
+	kind, name := key, ""
+	if split != -1 {
+		kind, name = key[:split], key[split+1:]
+	}
+
+	switch kind {
+	case "src":
+		switch {
+		case !hadOld:
+			return fmt.Sprintf("source %s added", name)
+		case !hasCur || cur == "missing":
+			return fmt.Sprintf("source %s removed", name)
+		}
+		return fmt.Sprintf("source %s changed since the last build", name)
+	case "dep":
+		if _, ok := Packages["\""+name+"\""]; ok {
+			if !hasCur {
+				return fmt.Sprintf("dependency \"%s\" no longer imported", name)
+			}
+			return fmt.Sprintf("dependency \"%s\" rebuilt", name)
+		}
+		where := "installed"
+		if _, found := Tools.GOROOTArchive(name); found {
+			where = "GOROOT"
+		}
+		switch {
+		case !hadOld:
+			return fmt.Sprintf("%s package %s newly imported", where, Tools.ArchiveName(name))
+		case !hasCur:
+			return fmt.Sprintf("%s package %s no longer imported", where, Tools.ArchiveName(name))
+		}
+		return fmt.Sprintf("%s package %s changed", where, Tools.ArchiveName(name))
+	case "flags":
+		return fmt.Sprintf("%s flags changed from %q to %q", name, old, cur)
+	case "tool":
+		return fmt.Sprintf("%s tool changed", name)
+	case "env":
+		return fmt.Sprintf("$%s changed from %s to %s", name, old, cur)
+	}
+	return fmt.Sprintf("%s changed from %q to %q", key, old, cur)
+}
+
+// WhyInstall says why -i would install the target, or returns "" if the
+// installed copy is current. rebuilt tells if the target would be rebuilt.
+func (this *Package) WhyInstall(rebuilt bool) string {
+	inTime := this.GOROOTPkgTime
+	if this.SourceTime > inTime {
+		inTime = this.SourceTime
+	}
+	for _, pkg := range this.DepPkgs {
+		if pkg.BinTime > inTime {
+			inTime = pkg.BinTime
+		}
+	}
+
+	switch {
+	case this.InstTime == 0:
+		return "never installed"
+	case rebuilt:
+		return "it would be rebuilt first"
+	case this.InstTime < this.BinTime:
+		return fmt.Sprintf("%s newer than %s", GetRelative(CWD, this.ResultPath, CWD), this.InstallPath)
+	case this.InstTime < inTime:
+		return fmt.Sprintf("its inputs are newer than %s", this.InstallPath)
+	}
+	return ""
+}